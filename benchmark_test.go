@@ -4,6 +4,8 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"strconv"
+	"sync/atomic"
 	"testing"
 
 	ratelimiter "github.com/ilam01/limits-go"
@@ -83,6 +85,52 @@ func BenchmarkGetForDifferentUser(b *testing.B) {
 	})
 }
 
+func BenchmarkGetAndContention(b *testing.B) {
+	for _, shards := range []int{1, 16, 64} {
+		b.Run("shards-"+strconv.Itoa(shards), func(b *testing.B) {
+			limiter := ratelimiter.New(ratelimiter.Options{Shards: shards})
+			defer limiter.Close()
+			policy := []int{1000000, 1000}
+			ids := make([]string, 1024)
+			for i := range ids {
+				ids[i] = getUniqueID()
+			}
+			var offset int64
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(atomic.AddInt64(&offset, 97))
+				for pb.Next() {
+					limiter.Get(context.Background(), ids[i%len(ids)], policy...)
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkGetAndContentionSameKey(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		b.Run("shards-"+strconv.Itoa(shards), func(b *testing.B) {
+			limiter := ratelimiter.New(ratelimiter.Options{Shards: shards})
+			defer limiter.Close()
+			policy := []int{1000000, 1000}
+			id := getUniqueID()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					limiter.Get(context.Background(), id, policy...)
+				}
+			})
+		})
+	}
+}
+
 func getUniqueID() string {
 	buf := make([]byte, 12)
 	_, err := rand.Read(buf)
@@ -0,0 +1,144 @@
+package ratelimiter
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of the circuit breaker around the redis client.
+type BreakerState int
+
+const (
+	// BreakerClosed calls redis normally.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen skips redis for Options.ProbeInterval, every call fails with ErrCircuitOpen.
+	BreakerOpen
+	// BreakerHalfOpen lets one call at a time probe redis, until Options.BreakerSuccesses calls
+	// succeed, or one fails and the breaker opens again.
+	BreakerHalfOpen
+)
+
+// String returns the name of the breaker state.
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "BreakerClosed"
+	case BreakerOpen:
+		return "BreakerOpen"
+	case BreakerHalfOpen:
+		return "BreakerHalfOpen"
+	default:
+		return "BreakerState(" + strconv.Itoa(int(s)) + ")"
+	}
+}
+
+// breaker is a circuit breaker, it opens after threshold consecutive failures, and skips the
+// backend for interval before probing it again. A nil breaker always allows the backend.
+type breaker struct {
+	threshold int
+	successes int
+	interval  time.Duration
+	onChange  func(from, to BreakerState)
+	clock     Clock
+	lock      sync.Mutex
+	state     BreakerState
+	failures  int
+	probes    int
+	probing   bool
+	retryAt   time.Time
+	changes   [][2]BreakerState // transitions to report after unlock
+}
+
+// allow reports whether a call can reach the backend, it must be followed by done or release
+// if so.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	defer b.unlock()
+	switch b.state {
+	case BreakerOpen:
+		if b.clock.Now().Before(b.retryAt) {
+			return false
+		}
+		b.transit(BreakerHalfOpen)
+		b.probes = 0
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+	default:
+		return true
+	}
+	b.probing = true
+	return true
+}
+
+// done records whether an allowed call failed.
+func (b *breaker) done(failed bool) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.unlock()
+	b.probing = false
+	if failed {
+		b.failures++
+		if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+			b.retryAt = b.clock.Now().Add(b.interval)
+			b.transit(BreakerOpen)
+		}
+		return
+	}
+	b.failures = 0
+	if b.state == BreakerHalfOpen {
+		if b.probes++; b.probes >= b.successes {
+			b.transit(BreakerClosed)
+		}
+	}
+}
+
+// release ends an allowed call without a result, e.g. canceled by the caller.
+func (b *breaker) release() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	b.probing = false
+	b.lock.Unlock()
+}
+
+// State returns the current state.
+func (b *breaker) State() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+// transit should be called with b.lock held.
+func (b *breaker) transit(state BreakerState) {
+	if state != BreakerOpen {
+		b.failures = 0
+	}
+	if b.state != state {
+		b.changes = append(b.changes, [2]BreakerState{b.state, state})
+		b.state = state
+	}
+}
+
+// unlock releases b.lock, then reports the transitions, so onChange can read the state.
+func (b *breaker) unlock() {
+	changes := b.changes
+	b.changes = nil
+	b.lock.Unlock()
+	if b.onChange != nil {
+		for _, change := range changes {
+			b.onChange(change[0], change[1])
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package ratelimiter
+
+import (
+	"strings"
+	"time"
+)
+
+// Clock reads the current time for a Limiter, and makes the timers of Wait. Options.Clock
+// defaults to the system clock.
+/*
+Clock makes tests deterministic without sleeping:
+
+    clock := ratelimitertest.NewManualClock(time.Unix(0, 0))
+    limiter := ratelimiter.New(ratelimiter.Options{Max: 1, Clock: clock})
+    limiter.Get(ctx, id) // Remaining: 0
+    limiter.Get(ctx, id) // Remaining: -1
+    clock.Advance(time.Minute)
+    limiter.Get(ctx, id) // Remaining: 0
+*/
+type Clock interface {
+	Now() time.Time
+	// NewTimer returns a Timer sending the current time on its channel after d.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer made by a Clock.
+type Timer interface {
+	C() <-chan time.Time
+	// Stop prevents the Timer from firing, it reports whether the Timer was active.
+	Stop() bool
+}
+
+// systemClock is the Clock of the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// serverTime returns script run with the redis server time, see Options.ServerTime.
+func serverTime(script string) string {
+	return strings.Replace(serverTimeLua, "-- script\n", script, 1)
+}
+
+// copy from ./servertime.lua
+const serverTimeLua string = `
+-- Runs a limiter script with the redis server time as the current timestamp.
+-- The client timestamp ARGV[1] is only used if the script effects can't be replicated.
+-- A table result is padded to 6 items, and the server timestamp is appended as res[7].
+
+local now = tonumber(ARGV[1])
+if redis.replicate_commands and redis.replicate_commands() then
+  local time = redis.call('TIME')
+  now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+end
+
+local argv = {}
+for i = 1, #ARGV do
+  argv[i] = ARGV[i]
+end
+argv[1] = now
+local ARGV = argv
+
+local res = (function()
+-- script
+end)()
+
+if type(res) == 'table' then
+  for i = 1, 6 do
+    res[i] = res[i] or 0
+  end
+  res[7] = now
+end
+return res
+`
@@ -0,0 +1,65 @@
+package ratelimiter
+
+import (
+	"errors"
+)
+
+var (
+	// ErrInvalidPolicy is returned for an invalid policy or cost, it's a configuration bug
+	// and retrying will not help.
+	ErrInvalidPolicy = errors.New("ratelimiter: invalid policy")
+	// ErrInvalidOptions is returned by NewWithError for invalid Options.
+	ErrInvalidOptions = errors.New("ratelimiter: invalid options")
+	// ErrClosed is returned by every call of a closed Limiter.
+	ErrClosed = errors.New("ratelimiter: limiter is closed")
+	// ErrBackendUnavailable is returned when the backend fails, every *BackendError is it.
+	ErrBackendUnavailable = errors.New("ratelimiter: backend unavailable")
+	// ErrCircuitOpen is the cause of a *BackendError when the circuit breaker skips redis.
+	ErrCircuitOpen = errors.New("ratelimiter: circuit breaker is open")
+	// ErrInvalidResponse is returned when the backend returns a result that can't be parsed.
+	ErrInvalidResponse = errors.New("ratelimiter: invalid response")
+	// ErrWaitExceedsDeadline is returned by Wait without waiting, when the request can't be
+	// permitted before the ctx deadline.
+	ErrWaitExceedsDeadline = errors.New("ratelimiter: Wait would exceed context deadline")
+)
+
+// BackendError is a failed call of the backend, e.g. the redis client. It wraps the cause, and
+// errors.Is(err, ErrBackendUnavailable) reports true for it.
+/*
+BackendError tells a redis outage apart from a configuration bug:
+
+    res, err := limiter.Get(ctx, userID)
+    var backendErr *ratelimiter.BackendError
+    if errors.As(err, &backendErr) {
+        log.Printf("ratelimiter %s failed: %v", backendErr.Op, backendErr.Err)
+    }
+*/
+type BackendError struct {
+	Op  string // The failed backend operation, e.g. "evalsha"
+	Err error  // The cause returned by the backend
+}
+
+func (e *BackendError) Error() string {
+	return "ratelimiter: " + e.Op + ": " + e.Err.Error()
+}
+
+// Unwrap returns the cause.
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrBackendUnavailable.
+func (e *BackendError) Is(target error) bool {
+	return target == ErrBackendUnavailable
+}
+
+// policyError is an ErrInvalidPolicy with a detailed message.
+type policyError string
+
+func (e policyError) Error() string {
+	return string(e)
+}
+
+func (e policyError) Is(target error) bool {
+	return target == ErrInvalidPolicy
+}
@@ -62,7 +62,7 @@ func main() {
 		header.Set("X-Ratelimit-Remaining", strconv.FormatInt(int64(res.Remaining), 10))
 		header.Set("X-Ratelimit-Reset", strconv.FormatInt(res.Reset.Unix(), 10))
 
-		if res.Remaining >= 0 {
+		if res.Allowed {
 			w.WriteHeader(200)
 			_, _ = fmt.Fprintf(w, "Path: %q\n", html.EscapeString(r.URL.Path))
 			_, _ = fmt.Fprintf(w, "Remaining: %d\n", res.Remaining)
@@ -70,7 +70,7 @@ func main() {
 			_, _ = fmt.Fprintf(w, "Duration: %v\n", res.Duration)
 			_, _ = fmt.Fprintf(w, "Reset: %v\n", res.Reset)
 		} else {
-			after := int64(res.Reset.Sub(time.Now())) / 1e9
+			after := int64((res.RetryAfter + time.Second - 1) / time.Second)
 			header.Set("Retry-After", strconv.FormatInt(after, 10))
 			w.WriteHeader(429)
 			_, _ = fmt.Fprintf(w, "Rate limit exceeded, retry in %d seconds.\n", after)
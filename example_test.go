@@ -6,19 +6,12 @@ import (
 	"time"
 
 	ratelimiter "github.com/ilam01/limits-go"
-
-	"github.com/go-redis/redis/v8"
 )
 
-func ExampleRatelimiterGo() {
-	client := redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-	})
-
+func ExampleLimiter_Get() {
 	limiter := ratelimiter.New(ratelimiter.Options{
-		Client:   &redisClient{client},
 		Max:      10,
-		Duration: time.Second, // limit to 1000 requests in 1 minute.
+		Duration: time.Second, // limit to 10 requests in 1 second.
 	})
 
 	userID := "user-123456"
@@ -0,0 +1,66 @@
+package ratelimiter
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expiryHeap is a min-heap of limit records by sweepAt, implements heap.Interface. The sweepAt
+// of a record is a lower bound of its deadline, it's checked again when the record is at the top.
+type expiryHeap []*limiterCacheItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].sweepAt.Before(h[j].sweepAt) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+func (h *expiryHeap) Push(x interface{}) {
+	item := x.(*limiterCacheItem)
+	item.heapIndex = len(*h)
+	*h = append(*h, item)
+}
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.heapIndex = -1
+	*h = old[:n-1]
+	return item
+}
+
+// deadline returns the time the record can be removed, after the record and the previous
+// window weight of a sliding window are gone.
+func (item *limiterCacheItem) deadline() time.Time {
+	deadline := item.expire.Add(item.duration)
+	if window := time.Unix(0, (item.window+2*int64(item.duration/time.Millisecond))*1e6); window.After(deadline) {
+		return window
+	}
+	return deadline
+}
+
+// sweep removes the limit records and their policy status expired before now, until the system
+// time passes budget. It should be called with s.lock held, and returns the removed count.
+func (s *memoryShard) sweep(now, budget time.Time) (removed int) {
+	for s.expiry.Len() > 0 && s.expiry[0].sweepAt.Before(now) {
+		if removed%64 == 63 && budget.Before(time.Now()) {
+			return
+		}
+		item := s.expiry[0]
+		deadline := item.deadline()
+		if status, ok := s.status["{"+item.key+"}:S"]; ok && status.expire.After(deadline) {
+			deadline = status.expire
+		}
+		if !deadline.Before(now) {
+			// the record is used after it's pushed
+			item.sweepAt = deadline
+			heap.Fix(&s.expiry, 0)
+			continue
+		}
+		s.remove(item.key)
+		removed++
+	}
+	return
+}
@@ -0,0 +1,99 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"strconv"
+)
+
+// FailureMode is how a Limiter handles backend errors, e.g. when redis is unreachable.
+type FailureMode int
+
+const (
+	// FailError returns the backend error, every caller decides what to do.
+	FailError FailureMode = iota
+	// FailOpen permits the request with a synthetic Result of the first policy tier, and
+	// returns no error.
+	FailOpen
+	// FailClosed refuses the request with a synthetic Result of the first policy tier, which
+	// can be retried after its Duration, and returns no error.
+	FailClosed
+	// FailFallback gets the result from Options.Fallback instead, e.g. a memory limiter. Without
+	// Fallback, a redis limiter falls back to an embedded memory limiter with the limits divided
+	// by Options.FallbackInstances, and its circuit breaker skips redis until a probe succeeds.
+	FailFallback
+)
+
+// String returns the name of the failure mode.
+func (f FailureMode) String() string {
+	switch f {
+	case FailError:
+		return "FailError"
+	case FailOpen:
+		return "FailOpen"
+	case FailClosed:
+		return "FailClosed"
+	case FailFallback:
+		return "FailFallback"
+	default:
+		return "FailureMode(" + strconv.Itoa(int(f)) + ")"
+	}
+}
+
+// fail handles a backend error of a request for id with the failure mode.
+func (l *Limiter) fail(ctx context.Context, id string, cost int, policy Policy, peek bool, err error) (Result, error) {
+	if l.failureMode == FailError {
+		return Result{}, err
+	}
+	if l.onFailure != nil && !errors.Is(err, ErrCircuitOpen) {
+		l.onFailure(ctx, l.prefix+id, err)
+	}
+	return l.degrade(ctx, id, cost, policy, peek)
+}
+
+// degrade returns the result of a request for id without the backend, by the failure mode.
+func (l *Limiter) degrade(ctx context.Context, id string, cost int, policy Policy, peek bool) (Result, error) {
+	key := l.prefix + id
+	if l.failureMode == FailFallback {
+		var result Result
+		var err error
+		policy = policy.divide(l.instances)
+		if peek {
+			result, err = l.fallback.PeekPolicy(ctx, id, policy)
+		} else {
+			result, err = l.fallback.GetNPolicy(ctx, id, cost, policy)
+		}
+		result.Degraded = true
+		return result, err
+	}
+
+	tier := Tier{Max: l.max, Duration: l.duration}
+	if len(policy) > 0 {
+		tier = policy[0]
+	}
+	result := Result{
+		Total:    tier.Max,
+		Duration: tier.Duration,
+		Reset:    l.clock.Now(),
+		Key:      key,
+		Degraded: true,
+	}
+	if l.failureMode == FailOpen {
+		result.Allowed = true
+		result.Remaining = tier.Max
+		if !peek {
+			result.Remaining = tier.Max - cost
+		}
+		if result.Remaining < 0 {
+			result.Remaining = 0
+		}
+	} else {
+		result.Remaining = -1
+		if peek {
+			result.Remaining = 0
+		}
+		result.Reset = result.Reset.Add(tier.Duration)
+		result.RetryAfter = tier.Duration
+	}
+	return result, nil
+}
@@ -0,0 +1,114 @@
+package ratelimiter
+
+import (
+	"time"
+)
+
+// arrive should be called with s.lock held.
+func (s *memoryShard) arrive(key string, t time.Time, cost int, args ...int) (remaining int, res *limiterCacheItem) {
+	total := int64(args[0])
+	duration := int64(args[1])
+	interval := duration * 1000 / total
+	if interval < 1 {
+		interval = 1
+	}
+	period := interval * total
+	now := t.UnixNano() / 1e3
+
+	var ok bool
+	if res, ok = s.store[key]; !ok {
+		res = &limiterCacheItem{tat: now}
+		s.put(key, res)
+	}
+	if res.tat < now {
+		res.tat = now
+	}
+
+	if tat := res.tat + int64(cost)*interval; tat-now > period {
+		remaining = -1
+	} else {
+		remaining = int((period - (tat - now)) / interval)
+		res.tat = tat
+	}
+	res.total = int(total)
+	res.duration = time.Duration(duration) * time.Millisecond
+	res.expire = time.Unix(0, res.tat*1e3)
+	return
+}
+
+// peekArrival should be called with s.lock held.
+func (s *memoryShard) peekArrival(key string, t time.Time, args ...int) []interface{} {
+	total := int64(args[0])
+	duration := int64(args[1])
+	interval := duration * 1000 / total
+	if interval < 1 {
+		interval = 1
+	}
+	period := interval * total
+	now := t.UnixNano() / 1e3
+
+	tat := now
+	if res, ok := s.store[key]; ok && res.tat > now {
+		tat = res.tat
+	}
+	remaining := (period - (tat - now)) / interval
+	if remaining < 0 {
+		remaining = 0
+	}
+	return []interface{}{int(remaining), int(total), time.Duration(duration) * time.Millisecond,
+		time.Unix(0, tat*1e3), time.Duration(0)}
+}
+
+func (item *limiterCacheItem) refundArrival(t time.Time, cost int, args ...int) bool {
+	now := t.UnixNano() / 1e3
+	if item.tat <= now {
+		return false
+	}
+	interval := int64(args[1]) * 1000 / int64(args[0])
+	if interval < 1 {
+		interval = 1
+	}
+	item.tat -= int64(cost) * interval
+	if item.tat < now {
+		item.tat = now
+	}
+	item.expire = time.Unix(0, item.tat*1e3)
+	return true
+}
+
+// copy from ./gcra.lua
+const gcraLua string = `
+-- KEYS[1] target string key
+-- ARGV[n >= 4] current timestamp, cost, max count, duration, ...
+-- Only the first max/duration pair is used.
+
+-- STRING: KEYS[1]
+--   theoretical arrival time (TAT) in microseconds
+
+local now = tonumber(ARGV[1]) * 1000
+local cost = tonumber(ARGV[2])
+local total = tonumber(ARGV[3])
+local duration = tonumber(ARGV[4])
+local interval = math.max(math.floor(duration * 1000 / total), 1)
+local period = interval * total
+
+local tat = tonumber(redis.call('get', KEYS[1])) or now
+if tat < now then
+  tat = now
+end
+
+local res = {}
+local newTat = tat + cost * interval
+if newTat - now > period then
+  res[1] = -1
+  newTat = tat
+else
+  res[1] = math.floor((period - (newTat - now)) / interval)
+  redis.call('set', KEYS[1], newTat, 'px', math.ceil((newTat - now) / 1000))
+end
+res[2] = total
+res[3] = duration
+res[4] = math.ceil(newTat / 1000)
+
+return res
+`
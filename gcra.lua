@@ -0,0 +1,33 @@
+-- KEYS[1] target string key
+-- ARGV[n >= 4] current timestamp, cost, max count, duration, ...
+-- Only the first max/duration pair is used.
+
+-- STRING: KEYS[1]
+--   theoretical arrival time (TAT) in microseconds
+
+local now = tonumber(ARGV[1]) * 1000
+local cost = tonumber(ARGV[2])
+local total = tonumber(ARGV[3])
+local duration = tonumber(ARGV[4])
+local interval = math.max(math.floor(duration * 1000 / total), 1)
+local period = interval * total
+
+local tat = tonumber(redis.call('get', KEYS[1])) or now
+if tat < now then
+  tat = now
+end
+
+local res = {}
+local newTat = tat + cost * interval
+if newTat - now > period then
+  res[1] = -1
+  newTat = tat
+else
+  res[1] = math.floor((period - (newTat - now)) / interval)
+  redis.call('set', KEYS[1], newTat, 'px', math.ceil((newTat - now) / 1000))
+end
+res[2] = total
+res[3] = duration
+res[4] = math.ceil(newTat / 1000)
+
+return res
@@ -3,6 +3,6 @@ module github.com/ilam01/limits-go
 go 1.15
 
 require (
-	github.com/go-redis/redis/v8 v8.10.0 // indirect
+	github.com/go-redis/redis/v8 v8.10.0
 	github.com/stretchr/testify v1.7.0
 )
@@ -0,0 +1,29 @@
+// Package scripts shares the SHA1 digests of the redis scripts of ratelimiter with
+// ratelimitertest, whose RedisClient emulates them in Go and matches them by the digests.
+package scripts
+
+// The names of the scripts emulated by ratelimitertest.
+const (
+	FixedWindow = "FixedWindow" // ratelimiter.lua
+	Peek        = "Peek"        // peek.lua
+	Refund      = "Refund"      // refund.lua
+)
+
+// Digests are the SHA1 hex digests of a script, run with the client time or with the redis
+// server time of Options.ServerTime.
+type Digests struct {
+	Sha1           string
+	ServerTimeSha1 string
+}
+
+var digests = make(map[string]Digests)
+
+// Register registers the digests of the named script, ratelimiter registers its scripts on init.
+func Register(name string, d Digests) {
+	digests[name] = d
+}
+
+// Lookup returns the digests of the named script.
+func Lookup(name string) Digests {
+	return digests[name]
+}
@@ -0,0 +1,97 @@
+package ratelimiter
+
+import (
+	"time"
+)
+
+// schedule should be called with s.lock held.
+func (s *memoryShard) schedule(key string, t time.Time, cost int, args ...int) (remaining int, res *limiterCacheItem) {
+	total := int64(args[0])
+	duration := int64(args[1])
+	interval := duration * 1000 / total
+	if interval < 1 {
+		interval = 1
+	}
+	period := interval * total
+	now := t.UnixNano() / 1e3
+
+	var ok bool
+	if res, ok = s.store[key]; !ok {
+		res = &limiterCacheItem{tat: now}
+		s.put(key, res)
+	}
+	if res.tat < now {
+		res.tat = now
+	}
+
+	if delay := res.tat - now; delay+int64(cost)*interval > period {
+		remaining = -1
+		res.delay = 0
+	} else {
+		res.tat += int64(cost) * interval
+		remaining = int((period - (res.tat - now)) / interval)
+		res.delay = time.Duration(delay) * time.Microsecond
+	}
+	res.total = int(total)
+	res.duration = time.Duration(duration) * time.Millisecond
+	res.expire = time.Unix(0, res.tat*1e3)
+	return
+}
+
+// peekSchedule should be called with s.lock held.
+func (s *memoryShard) peekSchedule(key string, t time.Time, args ...int) []interface{} {
+	// the queue is the same theoretical arrival time as GCRA, the next request is scheduled at it
+	res := s.peekArrival(key, t, args...)
+	now := t.UnixNano() / 1e3
+	if item, ok := s.store[key]; ok && item.tat > now {
+		res[4] = time.Duration(item.tat-now) * time.Microsecond
+	}
+	return res
+}
+
+func (item *limiterCacheItem) refundSchedule(t time.Time, cost int, reset time.Time, args ...int) bool {
+	// a queue slot can only be refunded when no request is scheduled after it
+	if item.tat != reset.UnixNano()/1e3 {
+		return false
+	}
+	return item.refundArrival(t, cost, args...)
+}
+
+// copy from ./leakybucket.lua
+const leakyBucketLua string = `
+-- KEYS[1] target string key
+-- ARGV[n >= 4] current timestamp, cost, max count, duration, ...
+-- Only the first max/duration pair is used.
+
+-- STRING: KEYS[1]
+--   time the queue is drained in microseconds, the next request is scheduled at it
+
+local now = tonumber(ARGV[1]) * 1000
+local cost = tonumber(ARGV[2])
+local total = tonumber(ARGV[3])
+local duration = tonumber(ARGV[4])
+local interval = math.max(math.floor(duration * 1000 / total), 1)
+local period = interval * total
+
+local tat = tonumber(redis.call('get', KEYS[1])) or now
+if tat < now then
+  tat = now
+end
+
+local res = {}
+local delay = tat - now
+if delay + cost * interval > period then
+  res[1] = -1
+  res[5] = 0
+else
+  tat = tat + cost * interval
+  res[1] = math.floor((period - (tat - now)) / interval)
+  res[5] = math.ceil(delay / 1000)
+  redis.call('set', KEYS[1], tat, 'px', math.ceil((tat - now) / 1000))
+end
+res[2] = total
+res[3] = duration
+res[4] = math.ceil(tat / 1000)
+
+return res
+`
@@ -0,0 +1,35 @@
+-- KEYS[1] target string key
+-- ARGV[n >= 4] current timestamp, cost, max count, duration, ...
+-- Only the first max/duration pair is used.
+
+-- STRING: KEYS[1]
+--   time the queue is drained in microseconds, the next request is scheduled at it
+
+local now = tonumber(ARGV[1]) * 1000
+local cost = tonumber(ARGV[2])
+local total = tonumber(ARGV[3])
+local duration = tonumber(ARGV[4])
+local interval = math.max(math.floor(duration * 1000 / total), 1)
+local period = interval * total
+
+local tat = tonumber(redis.call('get', KEYS[1])) or now
+if tat < now then
+  tat = now
+end
+
+local res = {}
+local delay = tat - now
+if delay + cost * interval > period then
+  res[1] = -1
+  res[5] = 0
+else
+  tat = tat + cost * interval
+  res[1] = math.floor((period - (tat - now)) / interval)
+  res[5] = math.ceil(delay / 1000)
+  redis.call('set', KEYS[1], tat, 'px', math.ceil((tat - now) / 1000))
+end
+res[2] = total
+res[3] = duration
+res[4] = math.ceil(tat / 1000)
+
+return res
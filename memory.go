@@ -1,8 +1,9 @@
 package ratelimiter
 
 import (
+	"container/heap"
+	"container/list"
 	"context"
-	"errors"
 	"sync"
 	"time"
 )
@@ -19,135 +20,277 @@ type limiterCacheItem struct {
 	remaining int
 	duration  time.Duration
 	expire    time.Time
+	tokens    int64         // token bucket level, in token-milliseconds
+	last      int64         // token bucket last refill timestamp
+	tat       int64         // GCRA theoretical arrival time, in microseconds
+	log       []logEntry    // sliding log of accepted requests, the oldest first
+	logged    int           // sliding log sum of the costs in log
+	window    int64         // sliding window current window start timestamp
+	current   int64         // sliding window current window count
+	previous  int64         // sliding window previous window count
+	delay     time.Duration // leaky bucket delay before the request slot
+	index     int           // fixed window policy index, starts from 1
+	key       string        // the key of the record in the shard
+	sweepAt   time.Time     // the time to check the deadline in the shard expiry heap
+	heapIndex int           // the index in the shard expiry heap
+	lru       *list.Element // the record in the shard LRU list, nil if the shard is unbounded
 }
 
 type memoryLimiter struct {
-	Ctx      context.Context
-	max      int
-	duration time.Duration
-	status   map[string]*statusCacheItem
-	store    map[string]*limiterCacheItem
-	ticker   *time.Ticker
-	lock     sync.Mutex
+	Ctx       context.Context
+	max       int
+	duration  time.Duration
+	algorithm Algorithm
+	clock     Clock
+	shards    []*memoryShard
+	ticker    *time.Ticker
+	done      chan struct{}
 }
 
-func newMemoryLimiter(opts *Options) *Limiter {
-	m := &memoryLimiter{
-		Ctx:      opts.Ctx,
-		max:      opts.Max,
-		duration: opts.Duration,
+// memoryShard holds the records of the keys hashed to it.
+type memoryShard struct {
+	status    map[string]*statusCacheItem
+	store     map[string]*limiterCacheItem
+	expiry    expiryHeap
+	lru       *list.List // records from the most recently used, nil if the shard is unbounded
+	capacity  int
+	evictions uint64
+	lock      sync.Mutex
+}
+
+// newMemoryShard returns a shard holding at most capacity keys, or unbounded if it's 0.
+func newMemoryShard(capacity int) *memoryShard {
+	s := &memoryShard{
 		store:    make(map[string]*limiterCacheItem),
 		status:   make(map[string]*statusCacheItem),
-		ticker:   time.NewTicker(time.Second),
+		capacity: capacity,
 	}
-	go m.cleanCache()
-	return &Limiter{m, opts.Prefix}
-}
-
-// abstractLimiter interface
-func (m *memoryLimiter) getLimit(ctx context.Context, key string, policy ...int) ([]interface{}, error) {
-	length := len(policy)
-	var args []int
-	if length == 0 {
-		args = []int{m.max, int(m.duration / time.Millisecond)}
-	} else {
-		args = make([]int, length)
-		for i, val := range policy {
-			if val <= 0 {
-				return nil, errors.New("ratelimiter: must be positive integer")
-			}
-			args[i] = policy[i]
+	if capacity > 0 {
+		s.lru = list.New()
+	}
+	return s
+}
+
+// put stores a new limit record for key, evicting the least recently used keys if the shard
+// is full. It should be called with s.lock held.
+func (s *memoryShard) put(key string, item *limiterCacheItem) {
+	if s.lru != nil {
+		for len(s.store) >= s.capacity {
+			s.remove(s.lru.Back().Value.(*limiterCacheItem).key)
+			s.evictions++
 		}
+		item.lru = s.lru.PushFront(item)
 	}
+	item.key = key
+	item.sweepAt = item.deadline()
+	s.store[key] = item
+	heap.Push(&s.expiry, item)
+}
 
-	res := m.getItem(key, args...)
-	m.lock.Lock()
-	defer m.lock.Unlock()
-	return []interface{}{res.remaining, res.total, res.duration, res.expire}, nil
+// touch marks the record as the most recently used, it should be called with s.lock held.
+func (s *memoryShard) touch(item *limiterCacheItem) {
+	if item.lru != nil {
+		s.lru.MoveToFront(item.lru)
+	}
 }
 
-// abstractLimiter interface
-func (m *memoryLimiter) removeLimit(ctx context.Context, key string) error {
-	statusKey := "{" + key + "}:S"
-	m.lock.Lock()
-	defer m.lock.Unlock()
-	delete(m.store, key)
-	delete(m.status, statusKey)
+// remove deletes the limit record and the policy status of key, it should be called with
+// s.lock held.
+func (s *memoryShard) remove(key string) {
+	if item, ok := s.store[key]; ok {
+		heap.Remove(&s.expiry, item.heapIndex)
+		if item.lru != nil {
+			s.lru.Remove(item.lru)
+		}
+	}
+	delete(s.store, key)
+	delete(s.status, "{"+key+"}:S")
+}
+
+// NewMemoryStore returns the Store of a memory limiter with given options, e.g. to wrap it in a
+// custom Store. The options of the Limiter, e.g. Prefix and FailureMode, are ignored.
+func NewMemoryStore(opts Options) (Store, error) {
+	if err := opts.init(); err != nil {
+		return nil, err
+	}
+	return newMemoryStore(&opts), nil
+}
+
+func newMemoryStore(opts *Options) *memoryLimiter {
+	m := &memoryLimiter{
+		Ctx:       opts.Ctx,
+		max:       opts.Max,
+		duration:  opts.Duration,
+		algorithm: opts.Algorithm,
+		clock:     opts.Clock,
+		ticker:    time.NewTicker(time.Second),
+		done:      make(chan struct{}),
+	}
+	// every shard holds at least one key, and the capacities add up to MaxKeys exactly
+	shards := opts.Shards
+	if opts.MaxKeys > 0 && opts.MaxKeys < shards {
+		shards = opts.MaxKeys
+	}
+	m.shards = make([]*memoryShard, shards)
+	for i := range m.shards {
+		capacity := opts.MaxKeys / shards
+		if i < opts.MaxKeys%shards {
+			capacity++
+		}
+		m.shards[i] = newMemoryShard(capacity)
+	}
+	go m.cleanCache()
+	return m
+}
+
+// shard returns the shard of key by its FNV-1a hash.
+func (m *memoryLimiter) shard(key string) *memoryShard {
+	if len(m.shards) == 1 {
+		return m.shards[0]
+	}
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return m.shards[hash%uint32(len(m.shards))]
+}
+
+// Take implements Store.
+func (m *memoryLimiter) Take(ctx context.Context, key string, cost int, policy Policy) (Result, error) {
+	args := m.args(policy)
+	now := m.clock.Now()
+
+	s := m.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var remaining int
+	var res *limiterCacheItem
+	switch m.algorithm {
+	case TokenBucket:
+		remaining, res = s.takeToken(key, now, cost, args...)
+	case GCRA:
+		remaining, res = s.arrive(key, now, cost, args...)
+	case SlidingLog:
+		remaining, res = s.logEvent(key, now, cost, args...)
+	case SlidingWindow:
+		remaining, res = s.countWindow(key, now, cost, args...)
+	case LeakyBucket:
+		remaining, res = s.schedule(key, now, cost, args...)
+	default:
+		remaining, res = s.getItem(key, now, cost, args...)
+	}
+	s.touch(res)
+	return parseResult([]interface{}{remaining, res.total, res.duration, res.expire, res.delay, res.index}), nil
+}
+
+// Peek implements Store.
+func (m *memoryLimiter) Peek(ctx context.Context, key string, policy Policy) (Result, error) {
+	args := m.args(policy)
+	now := m.clock.Now()
+
+	s := m.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch m.algorithm {
+	case TokenBucket:
+		return parseResult(s.peekToken(key, now, args...)), nil
+	case GCRA:
+		return parseResult(s.peekArrival(key, now, args...)), nil
+	case SlidingLog:
+		return parseResult(s.peekLog(key, now, args...)), nil
+	case SlidingWindow:
+		return parseResult(s.peekWindow(key, now, args...)), nil
+	case LeakyBucket:
+		return parseResult(s.peekSchedule(key, now, args...)), nil
+	default:
+		return parseResult(s.peekItem(key, now, args...)), nil
+	}
+}
+
+// Refund implements Store.
+func (m *memoryLimiter) Refund(ctx context.Context, key string, cost int, at, reset time.Time, policy Policy) (bool, error) {
+	args := m.args(policy)
+	now := m.clock.Now()
+
+	s := m.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res, ok := s.store[key]
+	if !ok {
+		return false, nil
+	}
+	switch m.algorithm {
+	case TokenBucket:
+		return res.refundToken(cost, args...), nil
+	case GCRA:
+		return res.refundArrival(now, cost, args...), nil
+	case SlidingLog:
+		return res.refundLog(now, cost, at, args...), nil
+	case SlidingWindow:
+		return res.refundWindow(cost, at, args...), nil
+	case LeakyBucket:
+		return res.refundSchedule(now, cost, reset, args...), nil
+	default:
+		return res.refundItem(cost, reset), nil
+	}
+}
+
+func (m *memoryLimiter) args(policy Policy) []int {
+	return policy.ints(m.max, m.duration)
+}
+
+// Remove implements Store.
+func (m *memoryLimiter) Remove(ctx context.Context, key string) error {
+	s := m.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.remove(key)
 	return nil
 }
 
+// evictions returns the count of keys evicted by the shard capacity.
+func (m *memoryLimiter) evictions() (n uint64) {
+	for _, s := range m.shards {
+		s.lock.Lock()
+		n += s.evictions
+		s.lock.Unlock()
+	}
+	return
+}
+
+// clean sweeps the shards one by one, so only one shard is locked at a time. The budget is
+// spent in the system time, whatever the clock is.
 func (m *memoryLimiter) clean() {
-	m.lock.Lock()
-	defer m.lock.Unlock()
-	start := time.Now()
-	expireTime := start.Add(time.Millisecond * 100)
-	frequency := 24
-	var expired int
-	for {
-	label:
-		for i := 0; i < frequency; i++ {
-			for key, value := range m.store {
-				if value.expire.Add(value.duration).Before(start) {
-					statusKey := "{" + key + "}:S"
-					delete(m.store, key)
-					delete(m.status, statusKey)
-					expired++
-				}
-				break
-			}
-		}
-		if expireTime.Before(time.Now()) {
-			return
-		}
-		if expired > frequency/4 {
-			expired = 0
-			goto label
-		}
-		return
+	now := m.clock.Now()
+	budget := time.Now().Add(time.Millisecond * 100)
+	for _, s := range m.shards {
+		s.lock.Lock()
+		s.sweep(now, budget)
+		s.lock.Unlock()
 	}
 }
 
-func (m *memoryLimiter) getItem(key string, args ...int) (res *limiterCacheItem) {
+// getItem should be called with s.lock held.
+func (s *memoryShard) getItem(key string, now time.Time, cost int, args ...int) (remaining int, res *limiterCacheItem) {
 	policyCount := len(args) / 2
 	statusKey := "{" + key + "}:S"
 
-	m.lock.Lock()
-	defer m.lock.Unlock()
 	var ok bool
-	if res, ok = m.store[key]; !ok {
+	if res, ok = s.store[key]; !ok {
 		res = &limiterCacheItem{
 			total:     args[0],
-			remaining: args[0] - 1,
+			remaining: args[0],
 			duration:  time.Duration(args[1]) * time.Millisecond,
-			expire:    time.Now().Add(time.Duration(args[1]) * time.Millisecond),
+			expire:    now.Add(time.Duration(args[1]) * time.Millisecond),
+			index:     1,
 		}
-		m.store[key] = res
-		return
-	}
-	if res.expire.After(time.Now()) {
-		if policyCount > 1 && res.remaining-1 == -1 {
-			statusItem, ok := m.status[statusKey]
-			if ok {
-				statusItem.expire = time.Now().Add(res.duration * 2)
-				statusItem.index++
-			} else {
-				statusItem := &statusCacheItem{
-					index:  2,
-					expire: time.Now().Add(time.Duration(args[1]) * time.Millisecond * 2),
-				}
-				m.status[statusKey] = statusItem
-			}
-		}
-		if res.remaining >= 0 {
-			res.remaining--
-		} else {
-			res.remaining = -1
-		}
-	} else {
+		s.put(key, res)
+	} else if !res.expire.After(now) {
 		index := 1
 		if policyCount > 1 {
-			if statusItem, ok := m.status[statusKey]; ok {
-				if statusItem.expire.Before(time.Now()) {
+			if statusItem, ok := s.status[statusKey]; ok {
+				if statusItem.expire.Before(now) {
 					index = 1
 				} else if statusItem.index > policyCount {
 					index = policyCount
@@ -160,15 +303,95 @@ func (m *memoryLimiter) getItem(key string, args ...int) (res *limiterCacheItem)
 		total := args[(index*2)-2]
 		duration := args[(index*2)-1]
 		res.total = total
-		res.remaining = total - 1
+		res.remaining = total
 		res.duration = time.Duration(duration) * time.Millisecond
-		res.expire = time.Now().Add(time.Duration(duration) * time.Millisecond)
+		res.expire = now.Add(time.Duration(duration) * time.Millisecond)
+		res.index = index
+	} else if policyCount > 1 && res.remaining == 0 {
+		statusItem, ok := s.status[statusKey]
+		if ok {
+			statusItem.expire = now.Add(res.duration * 2)
+			statusItem.index++
+		} else {
+			statusItem := &statusCacheItem{
+				index:  2,
+				expire: now.Add(time.Duration(args[1]) * time.Millisecond * 2),
+			}
+			s.status[statusKey] = statusItem
+		}
 	}
-	return
+
+	// refuse without consuming, but mark the exhausted window as exceeded once
+	if res.remaining < cost {
+		if res.remaining == 0 {
+			res.remaining = -1
+		}
+		return -1, res
+	}
+	res.remaining -= cost
+	return res.remaining, res
+}
+
+// peekItem should be called with s.lock held.
+func (s *memoryShard) peekItem(key string, now time.Time, args ...int) []interface{} {
+	if res, ok := s.store[key]; ok && res.expire.After(now) {
+		remaining := res.remaining
+		if remaining < 0 {
+			remaining = 0
+		}
+		return []interface{}{remaining, res.total, res.duration, res.expire, time.Duration(0), res.index}
+	}
+
+	policyCount := len(args) / 2
+	index := 1
+	if policyCount > 1 {
+		if statusItem, ok := s.status["{"+key+"}:S"]; ok && !statusItem.expire.Before(now) {
+			index = statusItem.index
+			if index > policyCount {
+				index = policyCount
+			}
+		}
+	}
+	total := args[(index*2)-2]
+	duration := time.Duration(args[(index*2)-1]) * time.Millisecond
+	return []interface{}{total, total, duration, now, time.Duration(0), index}
 }
 
+func (item *limiterCacheItem) refundItem(cost int, reset time.Time) bool {
+	if !item.expire.Equal(reset) {
+		return false
+	}
+	if item.remaining < 0 {
+		item.remaining = 0
+	}
+	item.remaining += cost
+	if item.remaining > item.total {
+		item.remaining = item.total
+	}
+	return true
+}
+
+// Close implements Store.
+func (m *memoryLimiter) Close() error {
+	close(m.done)
+	return nil
+}
+
+// cleanCache cleans the cache every tick, until the limiter is closed or its Ctx is done.
 func (m *memoryLimiter) cleanCache() {
-	for range m.ticker.C {
-		m.clean()
+	defer m.ticker.Stop()
+	var ctxDone <-chan struct{}
+	if m.Ctx != nil {
+		ctxDone = m.Ctx.Done()
+	}
+	for {
+		select {
+		case <-m.ticker.C:
+			m.clean()
+		case <-m.done:
+			return
+		case <-ctxDone:
+			return
+		}
 	}
 }
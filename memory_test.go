@@ -4,6 +4,8 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"runtime"
 	"testing"
 	"time"
 
@@ -182,36 +184,36 @@ func TestMemoryRateLimiter(t *testing.T) {
 		limiter := &memoryLimiter{
 			max:      opts.Max,
 			duration: opts.Duration,
-			store:    make(map[string]*limiterCacheItem),
-			status:   make(map[string]*statusCacheItem),
+			clock:    systemClock{},
+			shards:   []*memoryShard{newMemoryShard(0)},
 			ticker:   time.NewTicker(time.Minute),
 		}
 
 		id := genID()
-		policy := []int{10, 100}
+		policy := Policy{{Max: 10, Duration: 100 * time.Millisecond}}
 
-		res, _ := limiter.getLimit(ctx, id, policy...)
+		res, _ := limiter.Take(ctx, id, 1, policy)
 
-		assert.Equal(10, res[1].(int))
-		assert.Equal(9, res[0].(int))
+		assert.Equal(10, res.Total)
+		assert.Equal(9, res.Remaining)
 
-		time.Sleep(res[2].(time.Duration) + time.Millisecond)
+		time.Sleep(res.Duration + time.Millisecond)
 		limiter.clean()
-		res, _ = limiter.getLimit(ctx, id, policy...)
-		assert.Equal(10, res[1].(int))
-		assert.Equal(9, res[0].(int))
+		res, _ = limiter.Take(ctx, id, 1, policy)
+		assert.Equal(10, res.Total)
+		assert.Equal(9, res.Remaining)
 
-		time.Sleep(res[2].(time.Duration)*2 + time.Millisecond)
+		time.Sleep(res.Duration*2 + time.Millisecond)
 		limiter.clean()
-		res, _ = limiter.getLimit(ctx, id, policy...)
-		assert.Equal(10, res[1].(int))
-		assert.Equal(9, res[0].(int))
+		res, _ = limiter.Take(ctx, id, 1, policy)
+		assert.Equal(10, res.Total)
+		assert.Equal(9, res.Remaining)
 		limiter.ticker = time.NewTicker(time.Millisecond)
 		go limiter.cleanCache()
 		time.Sleep(2 * time.Millisecond)
-		res, _ = limiter.getLimit(ctx, id, policy...)
-		assert.Equal(10, res[1].(int))
-		assert.Equal(8, res[0].(int))
+		res, _ = limiter.Take(ctx, id, 1, policy)
+		assert.Equal(10, res.Total)
+		assert.Equal(8, res.Remaining)
 	})
 
 	t.Run("ratelimiter with big goroutine should be", func(t *testing.T) {
@@ -640,3 +642,1328 @@ func genID() string {
 	}
 	return hex.EncodeToString(buf)
 }
+
+func TestMemoryTokenBucket(t *testing.T) {
+	ctx := context.Background()
+	t.Run("token bucket with default Options should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: TokenBucket})
+		id := genID()
+
+		res, err := limiter.Get(ctx, id)
+		assert.Nil(err)
+		assert.Equal(100, res.Total)
+		assert.Equal(99, res.Remaining)
+		assert.Equal(time.Minute, res.Duration)
+		assert.True(res.Reset.After(time.Now()))
+		assert.True(res.Reset.Before(time.Now().Add(time.Second)))
+	})
+
+	t.Run("token bucket with exceeding should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: TokenBucket})
+		id := genID()
+		policy := []int{3, 300}
+
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(3, res.Total)
+		assert.Equal(2, res.Remaining)
+		assert.Equal(300*time.Millisecond, res.Duration)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(1, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+
+		// one token is refilled every 100ms
+		time.Sleep(100*time.Millisecond + time.Millisecond)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+
+		// a whole bucket after Reset
+		time.Sleep(res.Reset.Sub(time.Now()) + time.Millisecond)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(3, res.Total)
+		assert.Equal(2, res.Remaining)
+	})
+
+	t.Run("token bucket with multi-policy should use the first policy", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: TokenBucket})
+		id := genID()
+		policy := []int{2, 1000, 10, 2000}
+
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(2, res.Total)
+		assert.Equal(1, res.Remaining)
+		assert.Equal(time.Second, res.Duration)
+	})
+
+	t.Run("token bucket with Remove id should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: TokenBucket})
+		id := genID()
+		policy := []int{1, 1000}
+
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+		limiter.Remove(ctx, id)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(0, res.Remaining)
+	})
+
+	t.Run("token bucket with goroutine should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: TokenBucket})
+		id := genID()
+		policy := []int{50, 60000}
+
+		var wg sync.WaitGroup
+		wg.Add(100)
+		for i := 0; i < 100; i++ {
+			go func() {
+				limiter.Get(ctx, id, policy...)
+				wg.Done()
+			}()
+		}
+		wg.Wait()
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(-1, res.Remaining)
+	})
+}
+
+func TestMemoryGCRA(t *testing.T) {
+	ctx := context.Background()
+	t.Run("gcra with default Options should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: GCRA})
+		id := genID()
+
+		res, err := limiter.Get(ctx, id)
+		assert.Nil(err)
+		assert.Equal(100, res.Total)
+		assert.Equal(99, res.Remaining)
+		assert.Equal(time.Minute, res.Duration)
+		assert.True(res.Reset.After(time.Now()))
+		assert.True(res.Reset.Before(time.Now().Add(time.Second)))
+	})
+
+	t.Run("gcra with exceeding should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: GCRA})
+		id := genID()
+		policy := []int{3, 300}
+
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(3, res.Total)
+		assert.Equal(2, res.Remaining)
+		assert.Equal(300*time.Millisecond, res.Duration)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(1, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(0, res.Remaining)
+		reset := res.Reset
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+		assert.Equal(reset, res.Reset)
+
+		// one request is emitted every 100ms
+		time.Sleep(100*time.Millisecond + time.Millisecond)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+
+		time.Sleep(res.Reset.Sub(time.Now()) + time.Millisecond)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(3, res.Total)
+		assert.Equal(2, res.Remaining)
+	})
+
+	t.Run("gcra with Remove id should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: GCRA})
+		id := genID()
+		policy := []int{1, 1000}
+
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+		limiter.Remove(ctx, id)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(0, res.Remaining)
+	})
+
+	t.Run("gcra with goroutine should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: GCRA})
+		id := genID()
+		policy := []int{50, 60000}
+
+		var wg sync.WaitGroup
+		var allowed int
+		var mu sync.Mutex
+		wg.Add(100)
+		for i := 0; i < 100; i++ {
+			go func() {
+				res, _ := limiter.Get(ctx, id, policy...)
+				if res.Remaining >= 0 {
+					mu.Lock()
+					allowed++
+					mu.Unlock()
+				}
+				wg.Done()
+			}()
+		}
+		wg.Wait()
+		assert.Equal(50, allowed)
+	})
+}
+
+func TestMemorySlidingLog(t *testing.T) {
+	ctx := context.Background()
+	t.Run("sliding log with default Options should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: SlidingLog})
+		id := genID()
+
+		res, err := limiter.Get(ctx, id)
+		assert.Nil(err)
+		assert.Equal(100, res.Total)
+		assert.Equal(99, res.Remaining)
+		assert.Equal(time.Minute, res.Duration)
+		assert.True(res.Reset.After(time.Now().Add(59 * time.Second)))
+	})
+
+	t.Run("sliding log with trailing duration should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: SlidingLog})
+		id := genID()
+		policy := []int{2, 200}
+
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(2, res.Total)
+		assert.Equal(1, res.Remaining)
+		assert.Equal(200*time.Millisecond, res.Duration)
+		first := res.Reset
+
+		time.Sleep(100 * time.Millisecond)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(0, res.Remaining)
+		assert.Equal(first, res.Reset)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+
+		// the first request leaves the window, the second one is still in it
+		time.Sleep(res.Reset.Sub(time.Now()) + time.Millisecond)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+	})
+
+	t.Run("sliding log with changed policy should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: SlidingLog})
+		id := genID()
+
+		res, err := limiter.Get(ctx, id, 3, 1000)
+		assert.Nil(err)
+		res, err = limiter.Get(ctx, id, 3, 1000)
+		res, err = limiter.Get(ctx, id, 3, 1000)
+		assert.Equal(0, res.Remaining)
+
+		res, err = limiter.Get(ctx, id, 2, 1000)
+		assert.Equal(2, res.Total)
+		assert.Equal(-1, res.Remaining)
+
+		res, err = limiter.Get(ctx, id, 5, 1000)
+		assert.Equal(5, res.Total)
+		assert.Equal(1, res.Remaining)
+	})
+
+	t.Run("sliding log with cost should log one weighted request", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: SlidingLog})
+		id := genID()
+		policy := []int{10, 1000}
+
+		res, err := limiter.GetN(ctx, id, 4, policy...)
+		assert.Nil(err)
+		assert.Equal(6, res.Remaining)
+		res, err = limiter.GetN(ctx, id, 5, policy...)
+		assert.Equal(1, res.Remaining)
+		res, err = limiter.GetN(ctx, id, 2, policy...)
+		assert.Equal(-1, res.Remaining)
+		res, err = limiter.Peek(ctx, id, policy...)
+		assert.Equal(1, res.Remaining)
+
+		m := limiter.store.(*memoryLimiter)
+		item := m.shard("LIMIT:" + id).store["LIMIT:"+id]
+		assert.Equal(2, len(item.log))
+		assert.Equal(9, item.logged)
+		assert.True(item.refundLog(time.Now(), 6, time.Now(), policy...))
+		assert.Equal([]logEntry{{item.log[0].at, 3}}, item.log)
+		res, err = limiter.Peek(ctx, id, policy...)
+		assert.Equal(7, res.Remaining)
+	})
+
+	t.Run("sliding log with a big Max should grow with the requests", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: SlidingLog, Max: 10 << 20})
+		id := genID()
+
+		for i := 0; i < 3; i++ {
+			res, err := limiter.Get(ctx, id)
+			assert.Nil(err)
+			assert.Equal(10<<20-i-1, res.Remaining)
+		}
+		item := limiter.store.(*memoryLimiter).shard("LIMIT:" + id).store["LIMIT:"+id]
+		assert.Equal(3, len(item.log))
+		assert.True(cap(item.log) < 16)
+	})
+
+	t.Run("sliding log with Remove id should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: SlidingLog})
+		id := genID()
+		policy := []int{1, 1000}
+
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+		limiter.Remove(ctx, id)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(0, res.Remaining)
+	})
+}
+
+func TestMemorySlidingWindow(t *testing.T) {
+	ctx := context.Background()
+	// sleep until the given offset of a fixed window
+	waitWindow := func(duration, offset time.Duration) {
+		elapsed := time.Duration(time.Now().UnixNano()) % duration
+		time.Sleep(duration - elapsed + offset)
+	}
+
+	t.Run("sliding window with default Options should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: SlidingWindow})
+		id := genID()
+
+		res, err := limiter.Get(ctx, id)
+		assert.Nil(err)
+		assert.Equal(100, res.Total)
+		assert.Equal(99, res.Remaining)
+		assert.Equal(time.Minute, res.Duration)
+		assert.True(res.Reset.After(time.Now()))
+	})
+
+	t.Run("sliding window with weighted previous window should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: SlidingWindow})
+		id := genID()
+		policy := []int{3, 200}
+
+		waitWindow(200*time.Millisecond, 5*time.Millisecond)
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(3, res.Total)
+		assert.Equal(2, res.Remaining)
+		assert.Equal(200*time.Millisecond, res.Duration)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(1, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+
+		// half of the previous window is weighted: 3 * 0.5 + 1 requests
+		waitWindow(200*time.Millisecond, 100*time.Millisecond)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+
+		time.Sleep(res.Reset.Sub(time.Now()) + time.Millisecond)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(0, res.Remaining)
+	})
+
+	t.Run("sliding window with Remove id should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: SlidingWindow})
+		id := genID()
+		policy := []int{1, 60000}
+
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+		limiter.Remove(ctx, id)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(0, res.Remaining)
+	})
+
+	t.Run("sliding window with Clean cache should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := &memoryLimiter{
+			algorithm: SlidingWindow,
+			clock:     systemClock{},
+			shards:    []*memoryShard{newMemoryShard(0)},
+		}
+		id := genID()
+		policy := Policy{{Max: 10, Duration: 100 * time.Millisecond}}
+
+		waitWindow(100*time.Millisecond, 5*time.Millisecond)
+		limiter.Take(ctx, id, 1, policy)
+		waitWindow(100*time.Millisecond, 50*time.Millisecond)
+		limiter.clean()
+		assert.Equal(1, storeLen(limiter))
+		res, _ := limiter.Take(ctx, id, 1, policy)
+		assert.Equal(8, res.Remaining)
+
+		waitWindow(100*time.Millisecond, 105*time.Millisecond)
+		limiter.clean()
+		assert.Equal(0, storeLen(limiter))
+		res, _ = limiter.Take(ctx, id, 1, policy)
+		assert.Equal(9, res.Remaining)
+	})
+}
+
+func TestMemoryLeakyBucket(t *testing.T) {
+	ctx := context.Background()
+	t.Run("leaky bucket with default Options should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: LeakyBucket})
+		id := genID()
+
+		res, err := limiter.Get(ctx, id)
+		assert.Nil(err)
+		assert.Equal(100, res.Total)
+		assert.Equal(99, res.Remaining)
+		assert.Equal(time.Minute, res.Duration)
+		assert.Equal(time.Duration(0), res.Delay)
+	})
+
+	t.Run("leaky bucket with scheduled delay should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: LeakyBucket})
+		id := genID()
+		policy := []int{3, 300}
+
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(3, res.Total)
+		assert.Equal(2, res.Remaining)
+		assert.Equal(time.Duration(0), res.Delay)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(1, res.Remaining)
+		assert.True(res.Delay > 90*time.Millisecond && res.Delay <= 100*time.Millisecond)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(0, res.Remaining)
+		assert.True(res.Delay > 190*time.Millisecond && res.Delay <= 200*time.Millisecond)
+
+		// the queue is full
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+		assert.Equal(time.Duration(0), res.Delay)
+
+		// one slot is leaked every 100ms
+		time.Sleep(100*time.Millisecond + time.Millisecond)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(0, res.Remaining)
+		assert.True(res.Delay > 190*time.Millisecond && res.Delay <= 200*time.Millisecond)
+
+		time.Sleep(res.Reset.Sub(time.Now()) + time.Millisecond)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(2, res.Remaining)
+		assert.Equal(time.Duration(0), res.Delay)
+	})
+
+	t.Run("leaky bucket with Remove id should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: LeakyBucket})
+		id := genID()
+		policy := []int{1, 1000}
+
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+		limiter.Remove(ctx, id)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(0, res.Remaining)
+	})
+}
+
+func TestMemoryGetN(t *testing.T) {
+	ctx := context.Background()
+	algorithms := map[string]Algorithm{
+		"FixedWindow":   FixedWindow,
+		"TokenBucket":   TokenBucket,
+		"GCRA":          GCRA,
+		"SlidingLog":    SlidingLog,
+		"SlidingWindow": SlidingWindow,
+		"LeakyBucket":   LeakyBucket,
+	}
+	for name, algorithm := range algorithms {
+		t.Run(name+" with cost should be", func(t *testing.T) {
+			assert := assert.New(t)
+			limiter := New(Options{Algorithm: algorithm})
+			id := genID()
+			policy := []int{5, 3600000}
+
+			res, err := limiter.GetN(ctx, id, 3, policy...)
+			assert.Nil(err)
+			assert.Equal(5, res.Total)
+			assert.Equal(2, res.Remaining)
+
+			// refused without consuming
+			res, err = limiter.GetN(ctx, id, 3, policy...)
+			assert.Nil(err)
+			assert.Equal(-1, res.Remaining)
+
+			res, err = limiter.GetN(ctx, id, 2, policy...)
+			assert.Equal(0, res.Remaining)
+			res, err = limiter.Get(ctx, id, policy...)
+			assert.Equal(-1, res.Remaining)
+		})
+
+		t.Run(name+" with cost over max should be", func(t *testing.T) {
+			assert := assert.New(t)
+			limiter := New(Options{Algorithm: algorithm})
+			id := genID()
+			policy := []int{5, 3600000}
+
+			res, err := limiter.GetN(ctx, id, 6, policy...)
+			assert.Nil(err)
+			assert.Equal(-1, res.Remaining)
+			res, err = limiter.GetN(ctx, id, 5, policy...)
+			assert.Equal(0, res.Remaining)
+		})
+	}
+
+	t.Run("limiter.GetN with invalid cost", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{})
+		id := genID()
+
+		_, err := limiter.GetN(ctx, id, 0)
+		assert.Equal("ratelimiter: must be positive integer", err.Error())
+		_, err = limiter.GetN(ctx, id, -1, 10, 1000)
+		assert.Equal("ratelimiter: must be positive integer", err.Error())
+	})
+
+	t.Run("limiter.GetN with multi-policy should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{})
+		id := genID()
+		policy := []int{3, 100, 2, 200}
+
+		res, err := limiter.GetN(ctx, id, 2, policy...)
+		assert.Nil(err)
+		assert.Equal(1, res.Remaining)
+		// insufficient but not exhausted, keeps the first policy
+		res, err = limiter.GetN(ctx, id, 2, policy...)
+		assert.Equal(-1, res.Remaining)
+		time.Sleep(res.Duration + time.Millisecond)
+		res, err = limiter.GetN(ctx, id, 2, policy...)
+		assert.Equal(3, res.Total)
+		assert.Equal(1, res.Remaining)
+
+		// exhausted, escalates to the second policy
+		res, err = limiter.GetN(ctx, id, 1, policy...)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.GetN(ctx, id, 1, policy...)
+		assert.Equal(-1, res.Remaining)
+		time.Sleep(res.Duration + time.Millisecond)
+		res, err = limiter.GetN(ctx, id, 2, policy...)
+		assert.Equal(2, res.Total)
+		assert.Equal(0, res.Remaining)
+		assert.Equal(200*time.Millisecond, res.Duration)
+	})
+}
+
+func TestMemoryPeek(t *testing.T) {
+	ctx := context.Background()
+	algorithms := map[string]Algorithm{
+		"FixedWindow":   FixedWindow,
+		"TokenBucket":   TokenBucket,
+		"GCRA":          GCRA,
+		"SlidingLog":    SlidingLog,
+		"SlidingWindow": SlidingWindow,
+		"LeakyBucket":   LeakyBucket,
+	}
+	for name, algorithm := range algorithms {
+		t.Run(name+" with Peek should be", func(t *testing.T) {
+			assert := assert.New(t)
+			limiter := New(Options{Algorithm: algorithm})
+			id := genID()
+			policy := []int{3, 3600000}
+
+			res, err := limiter.Peek(ctx, id, policy...)
+			assert.Nil(err)
+			assert.Equal(3, res.Total)
+			assert.Equal(3, res.Remaining)
+			assert.Equal(time.Hour, res.Duration)
+
+			res, err = limiter.Get(ctx, id, policy...)
+			assert.Equal(2, res.Remaining)
+			res, err = limiter.Peek(ctx, id, policy...)
+			assert.Nil(err)
+			assert.Equal(2, res.Remaining)
+			res, err = limiter.Peek(ctx, id, policy...)
+			assert.Equal(2, res.Remaining)
+
+			res, err = limiter.GetN(ctx, id, 2, policy...)
+			assert.Equal(0, res.Remaining)
+			reset := res.Reset
+			res, err = limiter.Peek(ctx, id, policy...)
+			assert.Equal(0, res.Remaining)
+			assert.True(res.Reset.Sub(reset) < time.Millisecond && reset.Sub(res.Reset) < time.Millisecond)
+
+			res, err = limiter.Get(ctx, id, policy...)
+			assert.Equal(-1, res.Remaining)
+			res, err = limiter.Peek(ctx, id, policy...)
+			assert.Equal(0, res.Remaining)
+		})
+	}
+
+	t.Run("Peek with no record should not create it", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{})
+		id := genID()
+
+		res, err := limiter.Peek(ctx, id)
+		assert.Nil(err)
+		assert.Equal(100, res.Total)
+		assert.Equal(100, res.Remaining)
+		assert.Equal(time.Minute, res.Duration)
+		assert.Equal(0, storeLen(limiter.store.(*memoryLimiter)))
+	})
+
+	t.Run("Peek with multi-policy should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{})
+		id := genID()
+		policy := []int{2, 100, 3, 200}
+
+		limiter.Get(ctx, id, policy...)
+		limiter.Get(ctx, id, policy...)
+		res, err := limiter.Peek(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.Peek(ctx, id, policy...)
+		assert.Equal(0, res.Remaining)
+
+		// Peek does not escalate the policy
+		time.Sleep(res.Duration + time.Millisecond)
+		res, err = limiter.Peek(ctx, id, policy...)
+		assert.Equal(2, res.Total)
+		assert.Equal(2, res.Remaining)
+
+		limiter.Get(ctx, id, policy...)
+		limiter.Get(ctx, id, policy...)
+		limiter.Get(ctx, id, policy...)
+		time.Sleep(res.Duration + time.Millisecond)
+		res, err = limiter.Peek(ctx, id, policy...)
+		assert.Equal(3, res.Total)
+		assert.Equal(3, res.Remaining)
+		assert.Equal(200*time.Millisecond, res.Duration)
+	})
+
+	t.Run("Peek with invalid args", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{})
+		id := genID()
+
+		_, err := limiter.Peek(ctx, id, 10)
+		assert.Equal("ratelimiter: must be paired values", err.Error())
+		_, err = limiter.Peek(ctx, id, 10, 0)
+		assert.Equal("ratelimiter: must be positive integer", err.Error())
+	})
+}
+
+func TestMemoryWait(t *testing.T) {
+	t.Run("Wait with permitted request should return at once", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{})
+		id := genID()
+
+		start := time.Now()
+		err := limiter.Wait(context.Background(), id, 1, 1000)
+		assert.Nil(err)
+		assert.True(time.Since(start) < 50*time.Millisecond)
+	})
+
+	t.Run("Wait with exceeded request should wait for Reset", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{})
+		id := genID()
+		policy := []int{1, 100}
+
+		res, err := limiter.Get(context.Background(), id, policy...)
+		assert.Nil(err)
+		assert.Equal(0, res.Remaining)
+
+		err = limiter.Wait(context.Background(), id, policy...)
+		assert.Nil(err)
+		assert.True(time.Now().After(res.Reset))
+
+		res, err = limiter.Peek(context.Background(), id, policy...)
+		assert.Equal(0, res.Remaining)
+	})
+
+	t.Run("Wait with Reset after deadline should fail fast", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{})
+		id := genID()
+		policy := []int{1, 1000}
+
+		limiter.Get(context.Background(), id, policy...)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		err := limiter.Wait(ctx, id, policy...)
+		assert.True(errors.Is(err, ErrWaitExceedsDeadline))
+		assert.True(time.Since(start) < 50*time.Millisecond)
+	})
+
+	t.Run("Wait with canceled context should return its error", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{})
+		id := genID()
+		policy := []int{1, 1000}
+
+		limiter.Get(context.Background(), id, policy...)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+		}()
+
+		err := limiter.Wait(ctx, id, policy...)
+		assert.Equal(context.Canceled, err)
+
+		err = limiter.Wait(ctx, id, policy...)
+		assert.Equal(context.Canceled, err)
+	})
+
+	t.Run("WaitN with cost over the limit should fail fast", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{})
+		id := genID()
+
+		start := time.Now()
+		err := limiter.WaitN(context.Background(), id, 3, 2, 1000)
+		assert.True(errors.Is(err, ErrInvalidPolicy))
+		assert.True(time.Since(start) < 50*time.Millisecond)
+		err = limiter.WaitN(context.Background(), id, 3, 10, 1000, 2, 100)
+		assert.True(errors.Is(err, ErrInvalidPolicy))
+		assert.Nil(limiter.WaitN(context.Background(), id, 2, 2, 1000))
+	})
+
+	t.Run("WaitN with LeakyBucket should wait for the slot", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: LeakyBucket})
+		id := genID()
+		policy := []int{10, 1000}
+
+		start := time.Now()
+		err := limiter.WaitN(context.Background(), id, 2, policy...)
+		assert.Nil(err)
+		err = limiter.Wait(context.Background(), id, policy...)
+		assert.Nil(err)
+		assert.True(time.Since(start) >= 190*time.Millisecond)
+	})
+}
+
+func TestMemoryReserve(t *testing.T) {
+	ctx := context.Background()
+	algorithms := map[string]Algorithm{
+		"FixedWindow":   FixedWindow,
+		"TokenBucket":   TokenBucket,
+		"GCRA":          GCRA,
+		"SlidingLog":    SlidingLog,
+		"SlidingWindow": SlidingWindow,
+		"LeakyBucket":   LeakyBucket,
+	}
+	for name, algorithm := range algorithms {
+		t.Run(name+" with Cancel should refund", func(t *testing.T) {
+			assert := assert.New(t)
+			limiter := New(Options{Algorithm: algorithm})
+			id := genID()
+			policy := []int{3, 3600000}
+
+			r, err := limiter.ReserveN(ctx, id, 2, policy...)
+			assert.Nil(err)
+			assert.True(r.OK())
+			assert.Equal(1, r.Remaining)
+
+			refunded, err := r.Cancel(ctx)
+			assert.Nil(err)
+			assert.True(refunded)
+			res, err := limiter.Peek(ctx, id, policy...)
+			assert.Equal(3, res.Remaining)
+
+			// refunded at most once
+			refunded, err = r.Cancel(ctx)
+			assert.Nil(err)
+			assert.False(refunded)
+			res, err = limiter.Peek(ctx, id, policy...)
+			assert.Equal(3, res.Remaining)
+		})
+	}
+
+	t.Run("Reserve with refused request should not refund", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{})
+		id := genID()
+		policy := []int{1, 60000}
+
+		limiter.Get(ctx, id, policy...)
+		r, err := limiter.Reserve(ctx, id, policy...)
+		assert.Nil(err)
+		assert.False(r.OK())
+		refunded, err := r.Cancel(ctx)
+		assert.Nil(err)
+		assert.False(refunded)
+	})
+
+	t.Run("Reserve with next window should not refund", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{})
+		id := genID()
+		policy := []int{2, 100}
+
+		r, err := limiter.Reserve(ctx, id, policy...)
+		assert.Nil(err)
+		time.Sleep(r.Duration + time.Millisecond)
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Equal(1, res.Remaining)
+
+		refunded, err := r.Cancel(ctx)
+		assert.Nil(err)
+		assert.False(refunded)
+		res, err = limiter.Peek(ctx, id, policy...)
+		assert.Equal(1, res.Remaining)
+	})
+
+	t.Run("Reserve with LeakyBucket should only refund the last slot", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: LeakyBucket})
+		id := genID()
+		policy := []int{3, 3600000}
+
+		first, err := limiter.Reserve(ctx, id, policy...)
+		assert.Nil(err)
+		last, err := limiter.Reserve(ctx, id, policy...)
+		assert.Nil(err)
+
+		refunded, err := first.Cancel(ctx)
+		assert.Nil(err)
+		assert.False(refunded)
+		refunded, err = last.Cancel(ctx)
+		assert.Nil(err)
+		assert.True(refunded)
+		res, err := limiter.Peek(ctx, id, policy...)
+		assert.Equal(2, res.Remaining)
+	})
+}
+
+func TestMemoryPolicy(t *testing.T) {
+	ctx := context.Background()
+	t.Run("ParsePolicy should be", func(t *testing.T) {
+		assert := assert.New(t)
+
+		policy, err := ParsePolicy("100/1m, 50/1m, 50/2m")
+		assert.Nil(err)
+		assert.Equal(Policy{
+			{Max: 100, Duration: time.Minute},
+			{Max: 50, Duration: time.Minute},
+			{Max: 50, Duration: 2 * time.Minute},
+		}, policy)
+		assert.Equal("100/1m,50/1m,50/2m", policy.String())
+
+		policy, err = ParsePolicy("10/1500ms,5/1h")
+		assert.Nil(err)
+		assert.Equal("10/1500ms,5/1h", policy.String())
+		policy, err = ParsePolicy("")
+		assert.Nil(err)
+		assert.Equal(0, len(policy))
+	})
+
+	t.Run("ParsePolicy with invalid tiers", func(t *testing.T) {
+		assert := assert.New(t)
+
+		for _, s := range []string{"100", "100/1m/2m", "a/1m", "100/1x", "100/1m,"} {
+			_, err := ParsePolicy(s)
+			assert.NotNil(err, s)
+		}
+		_, err := ParsePolicy("0/1m")
+		assert.Equal("ratelimiter: must be positive integer", err.Error())
+		_, err = ParsePolicy("10/1us")
+		assert.Equal("ratelimiter: duration must be at least 1ms", err.Error())
+	})
+
+	t.Run("NewPolicy should be", func(t *testing.T) {
+		assert := assert.New(t)
+
+		policy, err := NewPolicy(100, 60000, 50, 120000)
+		assert.Nil(err)
+		assert.Equal("100/1m,50/2m", policy.String())
+		_, err = NewPolicy(100)
+		assert.Equal("ratelimiter: must be paired values", err.Error())
+		_, err = NewPolicy(100, 0)
+		assert.Equal("ratelimiter: must be positive integer", err.Error())
+	})
+
+	t.Run("GetPolicy with multi-policy should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{})
+		id := genID()
+		policy := Policy{
+			{Max: 2, Duration: 100 * time.Millisecond},
+			{Max: 1, Duration: 200 * time.Millisecond},
+		}
+
+		res, err := limiter.GetPolicy(ctx, id, policy)
+		assert.Nil(err)
+		assert.Equal(2, res.Total)
+		assert.Equal(1, res.Remaining)
+		// the typed and paired values policies share the same record
+		res, err = limiter.Get(ctx, id, 2, 100, 1, 200)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.GetPolicy(ctx, id, policy)
+		assert.Equal(-1, res.Remaining)
+
+		time.Sleep(res.Duration + time.Millisecond)
+		res, err = limiter.GetPolicy(ctx, id, policy)
+		assert.Equal(1, res.Total)
+		assert.Equal(0, res.Remaining)
+		assert.Equal(200*time.Millisecond, res.Duration)
+
+		res, err = limiter.PeekPolicy(ctx, id, policy)
+		assert.Nil(err)
+		assert.Equal(0, res.Remaining)
+	})
+
+	t.Run("GetPolicy with invalid policy", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{})
+		id := genID()
+
+		_, err := limiter.Get(ctx, id, 10)
+		assert.True(errors.Is(err, ErrInvalidPolicy))
+		err = limiter.Wait(ctx, id, 10, 0)
+		assert.True(errors.Is(err, ErrInvalidPolicy))
+
+		_, err = limiter.GetPolicy(ctx, id, Policy{{Max: 10, Duration: time.Microsecond}})
+		assert.Equal("ratelimiter: duration must be at least 1ms", err.Error())
+		_, err = limiter.PeekPolicy(ctx, id, Policy{{Max: 0, Duration: time.Second}})
+		assert.Equal("ratelimiter: must be positive integer", err.Error())
+	})
+}
+
+func TestMemoryResult(t *testing.T) {
+	ctx := context.Background()
+	t.Run("Result with decision fields should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{})
+		id := genID()
+		policy := []int{1, 60000}
+
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.True(res.Allowed)
+		assert.Equal(time.Duration(0), res.RetryAfter)
+		assert.Equal(0, res.Tier)
+		assert.Equal("LIMIT:"+id, res.Key)
+
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.False(res.Allowed)
+		assert.True(res.RetryAfter > 59*time.Second && res.RetryAfter <= time.Minute)
+
+		res, err = limiter.Peek(ctx, id, policy...)
+		assert.Nil(err)
+		assert.False(res.Allowed)
+		assert.True(res.RetryAfter > 59*time.Second)
+		assert.Equal("LIMIT:"+id, res.Key)
+	})
+
+	t.Run("Result with multi-policy should have the active tier", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Prefix: "T:"})
+		id := genID()
+		policy := []int{1, 100, 1, 200, 1, 300}
+
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(0, res.Tier)
+		assert.Equal("T:"+id, res.Key)
+		limiter.Get(ctx, id, policy...)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(0, res.Tier)
+
+		time.Sleep(res.Duration + time.Millisecond)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.True(res.Allowed)
+		assert.Equal(1, res.Tier)
+		res, err = limiter.Peek(ctx, id, policy...)
+		assert.Equal(1, res.Tier)
+		limiter.Get(ctx, id, policy...)
+
+		time.Sleep(res.Duration + time.Millisecond)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(2, res.Tier)
+		assert.Equal(300*time.Millisecond, res.Duration)
+	})
+
+	t.Run("Result with TokenBucket should retry before the bucket is full", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Algorithm: TokenBucket})
+		id := genID()
+		policy := []int{10, 10000}
+
+		limiter.GetN(ctx, id, 10, policy...)
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.False(res.Allowed)
+		assert.True(res.RetryAfter > 900*time.Millisecond && res.RetryAfter <= time.Second)
+	})
+}
+
+func TestMemoryClose(t *testing.T) {
+	ctx := context.Background()
+	t.Run("Close should stop the cleanup goroutine", func(t *testing.T) {
+		assert := assert.New(t)
+		before := runtime.NumGoroutine()
+		limiters := make([]*Limiter, 100)
+		for i := range limiters {
+			limiters[i] = New(Options{})
+		}
+		assert.True(runtime.NumGoroutine() >= before+100)
+
+		for _, limiter := range limiters {
+			assert.Nil(limiter.Close())
+			assert.Nil(limiter.Close())
+		}
+		assert.True(waitGoroutines(before))
+	})
+
+	t.Run("closed limiter should return ErrClosed", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{})
+		id := genID()
+		r, err := limiter.Reserve(ctx, id)
+		assert.Nil(err)
+		limiter.Close()
+
+		_, err = limiter.Get(ctx, id)
+		assert.Equal(ErrClosed, err)
+		_, err = limiter.Peek(ctx, id)
+		assert.Equal(ErrClosed, err)
+		err = limiter.Wait(ctx, id)
+		assert.Equal(ErrClosed, err)
+		_, err = limiter.Reserve(ctx, id)
+		assert.Equal(ErrClosed, err)
+		_, err = r.Cancel(ctx)
+		assert.Equal(ErrClosed, err)
+		assert.Equal(ErrClosed, limiter.Remove(ctx, id))
+	})
+
+	t.Run("Options.Ctx done should close the limiter", func(t *testing.T) {
+		assert := assert.New(t)
+		before := runtime.NumGoroutine()
+		cancelCtx, cancel := context.WithCancel(ctx)
+		limiter := New(Options{Ctx: cancelCtx})
+		id := genID()
+
+		_, err := limiter.Get(ctx, id)
+		assert.Nil(err)
+		cancel()
+		_, err = limiter.Get(ctx, id)
+		assert.Equal(ErrClosed, err)
+		assert.True(waitGoroutines(before))
+	})
+}
+
+func storeLen(m *memoryLimiter) (n int) {
+	for _, s := range m.shards {
+		n += len(s.store)
+	}
+	return
+}
+
+func statusLen(m *memoryLimiter) (n int) {
+	for _, s := range m.shards {
+		n += len(s.status)
+	}
+	return
+}
+
+func expiryLen(m *memoryLimiter) (n int) {
+	for _, s := range m.shards {
+		n += s.expiry.Len()
+	}
+	return
+}
+
+// waitGoroutines reports whether the goroutine count drops to n in a second.
+func waitGoroutines(n int) bool {
+	for i := 0; i < 100; i++ {
+		if runtime.NumGoroutine() <= n {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestMemoryExpiry(t *testing.T) {
+	ctx := context.Background()
+	algorithms := map[string]Algorithm{
+		"FixedWindow":   FixedWindow,
+		"TokenBucket":   TokenBucket,
+		"GCRA":          GCRA,
+		"SlidingLog":    SlidingLog,
+		"SlidingWindow": SlidingWindow,
+		"LeakyBucket":   LeakyBucket,
+	}
+	for name, algorithm := range algorithms {
+		t.Run(name+" with expired keys should shrink the store", func(t *testing.T) {
+			assert := assert.New(t)
+			limiter := New(Options{Algorithm: algorithm})
+			defer limiter.Close()
+			m := limiter.store.(*memoryLimiter)
+			policy := []int{2, 100, 1, 200}
+
+			for i := 0; i < 2000; i++ {
+				id := genID()
+				limiter.Get(ctx, id, policy...)
+				limiter.Get(ctx, id, policy...)
+				limiter.Get(ctx, id, policy...)
+			}
+			m.clean()
+			assert.Equal(2000, storeLen(m))
+
+			time.Sleep(300 * time.Millisecond)
+			m.clean()
+			assert.Equal(0, storeLen(m))
+			assert.Equal(0, statusLen(m))
+			assert.Equal(0, expiryLen(m))
+		})
+	}
+
+	t.Run("sweep should keep used records", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{})
+		defer limiter.Close()
+		m := limiter.store.(*memoryLimiter)
+		id := genID()
+		policy := []int{10, 20}
+
+		for i := 0; i < 5; i++ {
+			limiter.Get(ctx, id, policy...)
+			limiter.Get(ctx, genID(), policy...)
+			time.Sleep(20 * time.Millisecond)
+			m.clean()
+		}
+		// the last random record may not expire yet
+		assert.True(storeLen(m) <= 2)
+		_, ok := m.shard("LIMIT:" + id).store["LIMIT:"+id]
+		assert.True(ok)
+	})
+
+	t.Run("sweep should keep records with escalated policy status", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{})
+		defer limiter.Close()
+		m := limiter.store.(*memoryLimiter)
+		id := genID()
+		policy := []int{1, 100, 1, 1000}
+
+		// the status expires 200ms after exhausted, later than the record
+		limiter.Get(ctx, id, policy...)
+		time.Sleep(50 * time.Millisecond)
+		limiter.Get(ctx, id, policy...)
+		time.Sleep(170 * time.Millisecond)
+		m.clean()
+		assert.Equal(1, storeLen(m))
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(1, res.Tier)
+	})
+
+	t.Run("sweep should drop removed records", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{})
+		defer limiter.Close()
+		m := limiter.store.(*memoryLimiter)
+		id := genID()
+		policy := []int{10, 20}
+
+		limiter.Get(ctx, id, policy...)
+		limiter.Remove(ctx, id)
+		assert.Equal(0, expiryLen(m))
+		limiter.Get(ctx, id, policy...)
+		assert.Equal(1, expiryLen(m))
+		time.Sleep(50 * time.Millisecond)
+		m.clean()
+		assert.Equal(0, storeLen(m))
+		assert.Equal(0, expiryLen(m))
+	})
+}
+
+func TestMemoryShards(t *testing.T) {
+	ctx := context.Background()
+	t.Run("keys should be spread over shards", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Shards: 8})
+		defer limiter.Close()
+		m := limiter.store.(*memoryLimiter)
+		assert.Equal(8, len(m.shards))
+
+		for i := 0; i < 1000; i++ {
+			limiter.Get(ctx, genID())
+		}
+		assert.Equal(1000, storeLen(m))
+		for _, s := range m.shards {
+			assert.True(len(s.store) > 0)
+		}
+		defaults := New(Options{})
+		defer defaults.Close()
+		assert.Equal(16, len(defaults.store.(*memoryLimiter).shards))
+	})
+
+	t.Run("sharded limiter with goroutine should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{Shards: 4})
+		defer limiter.Close()
+		policy := []int{50, 60000}
+		ids := make([]string, 20)
+		for i := range ids {
+			ids[i] = genID()
+		}
+
+		var wait sync.WaitGroup
+		wait.Add(len(ids) * 100)
+		for _, id := range ids {
+			for i := 0; i < 100; i++ {
+				go func(id string) {
+					limiter.Get(ctx, id, policy...)
+					wait.Done()
+				}(id)
+			}
+		}
+		wait.Wait()
+		for _, id := range ids {
+			res, err := limiter.Peek(ctx, id, policy...)
+			assert.Nil(err)
+			assert.Equal(0, res.Remaining)
+		}
+	})
+}
+
+func TestMemoryMaxKeys(t *testing.T) {
+	ctx := context.Background()
+	t.Run("MaxKeys should evict the least recently used keys", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{MaxKeys: 100, Shards: 1})
+		defer limiter.Close()
+		m := limiter.store.(*memoryLimiter)
+		policy := []int{10, 60000}
+		hot := genID()
+
+		for i := 0; i < 1000; i++ {
+			limiter.Get(ctx, genID(), policy...)
+			if i%50 == 0 {
+				limiter.Get(ctx, hot, policy...)
+			}
+		}
+		assert.Equal(100, storeLen(m))
+		assert.Equal(uint64(901), limiter.Evictions())
+		res, err := limiter.Peek(ctx, hot, policy...)
+		assert.Nil(err)
+		assert.Equal(0, res.Remaining)
+
+		limiter.Remove(ctx, hot)
+		assert.Equal(99, storeLen(m))
+		assert.Equal(99, expiryLen(m))
+		assert.Equal(99, m.shards[0].lru.Len())
+	})
+
+	t.Run("MaxKeys should be split over shards", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{MaxKeys: 100, Shards: 8, Algorithm: TokenBucket})
+		defer limiter.Close()
+		m := limiter.store.(*memoryLimiter)
+
+		for i := 0; i < 10000; i++ {
+			limiter.Get(ctx, genID())
+		}
+		assert.Equal(100, storeLen(m))
+		assert.Equal(uint64(9900), limiter.Evictions())
+	})
+
+	t.Run("MaxKeys below Shards should track exactly MaxKeys keys", func(t *testing.T) {
+		assert := assert.New(t)
+		for _, maxKeys := range []int{1, 10} {
+			limiter := New(Options{MaxKeys: maxKeys})
+			defer limiter.Close()
+			m := limiter.store.(*memoryLimiter)
+			assert.Equal(maxKeys, len(m.shards))
+
+			for i := 0; i < 1000; i++ {
+				limiter.Get(ctx, genID())
+			}
+			assert.Equal(maxKeys, storeLen(m))
+		}
+	})
+
+	t.Run("evicted key should start over", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := New(Options{MaxKeys: 1, Shards: 1})
+		defer limiter.Close()
+		id := genID()
+		policy := []int{2, 60000}
+
+		limiter.Get(ctx, id, policy...)
+		limiter.Get(ctx, id, policy...)
+		limiter.Get(ctx, genID(), policy...)
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(1, res.Remaining)
+		assert.Equal(uint64(2), limiter.Evictions())
+		unbounded := New(Options{})
+		defer unbounded.Close()
+		assert.Equal(uint64(0), unbounded.Evictions())
+	})
+}
@@ -0,0 +1,116 @@
+-- KEYS[1] target key
+-- KEYS[2] target status hash key
+-- ARGV[n >= 4] current timestamp, algorithm, max count, duration, max count, duration, ...
+-- Read-only: returns the current limit without consuming or changing anything.
+
+local now = tonumber(ARGV[1])
+local algorithm = ARGV[2]
+local total = tonumber(ARGV[3])
+local duration = tonumber(ARGV[4])
+
+local res = {}
+res[2] = total
+res[3] = duration
+
+if algorithm == 'TokenBucket' then
+
+  local full = total * duration
+  local bucket = redis.call('hmget', KEYS[1], 'tk', 'ts')
+  local tokens = tonumber(bucket[1]) or full
+  local last = tonumber(bucket[2]) or now
+  if now > last then
+    tokens = math.min(full, tokens + (now - last) * total)
+    last = now
+  end
+  res[1] = math.floor(tokens / duration)
+  res[4] = last + math.ceil((full - tokens) / total)
+
+elseif algorithm == 'GCRA' or algorithm == 'LeakyBucket' then
+
+  local micros = now * 1000
+  local interval = math.max(math.floor(duration * 1000 / total), 1)
+  local period = interval * total
+  local tat = math.max(tonumber(redis.call('get', KEYS[1])) or micros, micros)
+  res[1] = math.max(math.floor((period - (tat - micros)) / interval), 0)
+  res[4] = math.ceil(tat / 1000)
+  if algorithm == 'LeakyBucket' then
+    res[5] = math.ceil((tat - micros) / 1000)
+  end
+
+elseif algorithm == 'SlidingLog' then
+
+  -- members are timestamp-sum-cost, see ./slidinglog.lua
+  local function parse(member)
+    local _, _, sum, weight = string.find(member, '%-(%d+)%-(%d+)$')
+    return tonumber(sum), tonumber(weight)
+  end
+  local min = '(' .. (now - duration)
+  local count = 0
+  local oldest = redis.call('zrangebyscore', KEYS[1], min, '+inf', 'withscores', 'limit', 0, 1)
+  if #oldest > 0 then
+    local newest = redis.call('zrevrangebyscore', KEYS[1], '+inf', min, 'limit', 0, 1)
+    local first, weight = parse(oldest[1])
+    count = parse(newest[1]) - first + weight
+  end
+  res[1] = math.max(total - count, 0)
+  res[4] = (tonumber(oldest[2]) or now) + duration
+
+elseif algorithm == 'SlidingWindow' then
+
+  local start = now - now % duration
+  local window = redis.call('hmget', KEYS[1], 'ws', 'cc', 'pc')
+  local last = tonumber(window[1]) or start
+  local current = tonumber(window[2]) or 0
+  local previous = tonumber(window[3]) or 0
+  if last > start then
+    start = last
+  elseif last < start then
+    if last + duration == start then
+      previous = current
+    else
+      previous = 0
+    end
+    current = 0
+  end
+
+  local elapsed = math.max(now - start, 0)
+  local weighted = previous * (duration - elapsed) + current * duration
+  res[1] = math.max(math.floor((total * duration - weighted) / duration), 0)
+
+  local target = (math.max(math.min(math.ceil(weighted / duration), total), 1) - 1) * duration
+  if current * duration <= target then
+    if previous > 0 then
+      res[4] = start + duration - math.floor((target - current * duration) / previous)
+    else
+      res[4] = now
+    end
+  else
+    res[4] = start + duration * 2 - math.floor(target / current)
+  end
+
+else
+
+  local limit = redis.call('hmget', KEYS[1], 'ct', 'lt', 'dn', 'rt', 'ix')
+  res[5] = 0
+  if limit[1] then
+    res[1] = math.max(tonumber(limit[1]), 0)
+    res[2] = tonumber(limit[2])
+    res[3] = tonumber(limit[3])
+    res[4] = tonumber(limit[4])
+    res[6] = tonumber(limit[5]) or 1
+  else
+    local policyCount = (#ARGV - 2) / 2
+    local index = 1
+    if policyCount > 1 then
+      index = math.min(tonumber(redis.call('get', KEYS[2])) or 1, policyCount)
+    end
+    res[1] = tonumber(ARGV[index * 2 + 1])
+    res[2] = res[1]
+    res[3] = tonumber(ARGV[index * 2 + 2])
+    res[4] = now
+    res[6] = index
+  end
+
+end
+
+return res
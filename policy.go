@@ -0,0 +1,137 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tier is a max count in duration of a Policy.
+type Tier struct {
+	Max      int
+	Duration time.Duration // It is truncated to milliseconds, and must be at least 1ms.
+}
+
+// String returns the tier as "max/duration", e.g. "100/1m".
+func (t Tier) String() string {
+	return strconv.Itoa(t.Max) + "/" + formatDuration(t.Duration)
+}
+
+// Policy is a custom limiter policy. For FixedWindow, the limiter escalates to the next tier
+// after a tier is exhausted, and the other algorithms only use the first tier.
+// An empty Policy uses Options.Max and Options.Duration.
+type Policy []Tier
+
+// NewPolicy returns a Policy from paired max count and duration in milliseconds values,
+// e.g. NewPolicy(100, 60000, 50, 60000, 50, 120000).
+func NewPolicy(policy ...int) (Policy, error) {
+	if odd := len(policy) % 2; odd == 1 {
+		return nil, policyError("ratelimiter: must be paired values")
+	}
+	p := make(Policy, len(policy)/2)
+	for i := range p {
+		max, duration := policy[i*2], policy[i*2+1]
+		if max <= 0 || duration <= 0 {
+			return nil, policyError("ratelimiter: must be positive integer")
+		}
+		p[i] = Tier{Max: max, Duration: time.Duration(duration) * time.Millisecond}
+	}
+	return p, nil
+}
+
+// ParsePolicy parses a Policy from its String form, e.g. "100/1m,50/1m,50/2m".
+// Durations are parsed by time.ParseDuration.
+func ParsePolicy(s string) (Policy, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Policy{}, nil
+	}
+	fields := strings.Split(s, ",")
+	p := make(Policy, len(fields))
+	for i, field := range fields {
+		pair := strings.Split(strings.TrimSpace(field), "/")
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("%w tier %q", ErrInvalidPolicy, field)
+		}
+		max, err := strconv.Atoi(strings.TrimSpace(pair[0]))
+		if err != nil {
+			return nil, fmt.Errorf("%w tier %q", ErrInvalidPolicy, field)
+		}
+		duration, err := time.ParseDuration(strings.TrimSpace(pair[1]))
+		if err != nil {
+			return nil, fmt.Errorf("%w tier %q", ErrInvalidPolicy, field)
+		}
+		p[i] = Tier{Max: max, Duration: duration}
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Validate reports whether every tier has a positive Max and a Duration of at least 1ms.
+func (p Policy) Validate() error {
+	for _, t := range p {
+		if t.Max <= 0 {
+			return policyError("ratelimiter: must be positive integer")
+		}
+		if t.Duration < time.Millisecond {
+			return policyError("ratelimiter: duration must be at least 1ms")
+		}
+	}
+	return nil
+}
+
+// String returns the policy as comma separated tiers, e.g. "100/1m,50/1m,50/2m".
+func (p Policy) String() string {
+	tiers := make([]string, len(p))
+	for i, t := range p {
+		tiers[i] = t.String()
+	}
+	return strings.Join(tiers, ",")
+}
+
+// ints returns paired max count and duration in milliseconds values, or the default tier if
+// the policy is empty.
+func (p Policy) ints(max int, duration time.Duration) []int {
+	if len(p) == 0 {
+		return []int{max, int(duration / time.Millisecond)}
+	}
+	args := make([]int, len(p)*2)
+	for i, t := range p {
+		args[i*2] = t.Max
+		args[i*2+1] = int(t.Duration / time.Millisecond)
+	}
+	return args
+}
+
+// divide returns the policy with every Max divided by n, rounded up.
+func (p Policy) divide(n int) Policy {
+	if n <= 1 || len(p) == 0 {
+		return p
+	}
+	divided := make(Policy, len(p))
+	for i, t := range p {
+		divided[i] = Tier{Max: (t.Max + n - 1) / n, Duration: t.Duration}
+	}
+	return divided
+}
+
+// formatDuration formats d with its largest whole unit, e.g. "1m" instead of "1m0s".
+func formatDuration(d time.Duration) string {
+	switch {
+	case d <= 0:
+		return d.String()
+	case d%time.Hour == 0:
+		return strconv.FormatInt(int64(d/time.Hour), 10) + "h"
+	case d%time.Minute == 0:
+		return strconv.FormatInt(int64(d/time.Minute), 10) + "m"
+	case d%time.Second == 0:
+		return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+	case d%time.Millisecond == 0:
+		return strconv.FormatInt(int64(d/time.Millisecond), 10) + "ms"
+	default:
+		return d.String()
+	}
+}
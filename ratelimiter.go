@@ -2,11 +2,15 @@ package ratelimiter
 
 import (
 	"context"
-	"errors"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/ilam01/limits-go/internal/scripts"
 )
 
 // RedisClient defines a redis client struct that ratelimiter need.
@@ -71,62 +75,353 @@ type RedisClient interface {
 
 // Limiter struct.
 type Limiter struct {
-	abstractLimiter
-	prefix string
+	store       Store
+	prefix      string
+	algorithm   Algorithm
+	max         int
+	duration    time.Duration
+	failureMode FailureMode
+	onFailure   func(ctx context.Context, key string, err error)
+	fallback    *Limiter
+	instances   int  // The fallback limits are divided by it, it's 1 for Options.Fallback
+	embedded    bool // The fallback is the embedded memory limiter, closed with the limiter
+	clock       Clock
+	ctx         context.Context
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+// Algorithm is the limiting algorithm used by a Limiter.
+type Algorithm int
+
+const (
+	// FixedWindow counts requests in fixed windows of Duration, with multi-policy support.
+	FixedWindow Algorithm = iota
+	// TokenBucket uses a bucket of Max tokens that is refilled continuously over Duration.
+	// Only the first max/duration pair of a policy is used, and Reset is the time the bucket is full again.
+	TokenBucket
+	// GCRA is the generic cell rate algorithm, it allows Max requests in any Duration without
+	// window edge bursts. Only the first max/duration pair of a policy is used, and Reset is the
+	// time all Max requests are available again.
+	GCRA
+	// SlidingLog logs every accepted request, and allows exactly Max requests in any trailing
+	// Duration. Only the first max/duration pair of a policy is used, and Reset is the time the
+	// oldest logged request leaves the window.
+	SlidingLog
+	// SlidingWindow approximates a sliding window with the counts of the current and the previous
+	// fixed windows, weighting the previous count by the time left in the current window. Only the
+	// first max/duration pair of a policy is used, and Reset is the time the interpolated count
+	// frees one more request.
+	SlidingWindow
+	// LeakyBucket shapes requests to a steady rate of Max per Duration: every accepted request is
+	// scheduled to a slot, and Result.Delay is the time to wait before it. Up to Max requests can
+	// be queued, Remaining is -1 when the queue is full. Only the first max/duration pair of a
+	// policy is used, and Reset is the time the queue is drained.
+	LeakyBucket
+)
+
+// String returns the name of the algorithm.
+func (a Algorithm) String() string {
+	switch a {
+	case FixedWindow:
+		return "FixedWindow"
+	case TokenBucket:
+		return "TokenBucket"
+	case GCRA:
+		return "GCRA"
+	case SlidingLog:
+		return "SlidingLog"
+	case SlidingWindow:
+		return "SlidingWindow"
+	case LeakyBucket:
+		return "LeakyBucket"
+	default:
+		return "Algorithm(" + strconv.Itoa(int(a)) + ")"
+	}
+}
+
+func (a Algorithm) script() string {
+	switch a {
+	case TokenBucket:
+		return tokenBucketLua
+	case GCRA:
+		return gcraLua
+	case SlidingLog:
+		return slidingLogLua
+	case SlidingWindow:
+		return slidingWindowLua
+	case LeakyBucket:
+		return leakyBucketLua
+	default:
+		return lua
+	}
 }
 
 // Options for Limiter
 type Options struct {
-	Ctx      context.Context
-	Max      int           // The max count in duration for no policy, default is 100.
-	Duration time.Duration // Count duration for no policy, default is 1 Minute.
-	Prefix   string        // Redis key prefix, default is "LIMIT:".
-	Client   RedisClient   // Use a redis client for limiter, if omit, it will use a memory limiter.
+	// Ctx closes the limiter when it's done, default is never.
+	Ctx       context.Context
+	Max       int           // The max count in duration for no policy, default is 100.
+	Duration  time.Duration // Count duration for no policy, default is 1 Minute.
+	Prefix    string        // Redis key prefix, default is "LIMIT:".
+	Client    RedisClient   // Use a redis client for limiter, if omit, it will use a memory limiter.
+	Store     Store         // Use a custom backend for limiter instead of Client or a memory limiter.
+	Algorithm Algorithm     // Limiting algorithm, default is FixedWindow.
+	LazyLoad  bool          // Load redis scripts on the first call instead of in New.
+	Shards    int           // Shard count of the memory limiter, default is 16.
+	Clock     Clock         // The time source of the limiter, default is the system clock.
+	// ServerTime makes the redis scripts read the redis TIME instead of Clock, so Reset and the
+	// windows don't drift with the clock skew of the clients. It needs script effects
+	// replication of redis 3.2+, or the scripts fall back to the Clock timestamp.
+	ServerTime bool
+	// MaxKeys is the max count of keys tracked by the memory limiter, the least recently used
+	// keys are evicted beyond it, default is 0 for no limit. It's split over the shards, which are
+	// at most MaxKeys, and a full shard evicts its keys even if the others are not full.
+	MaxKeys int
+
+	FailureMode FailureMode // How Get and Peek handle backend errors, default is FailError.
+	Fallback    *Limiter    // The limiter used by FailFallback when the backend errors.
+	// FallbackInstances is the expected instance count sharing the redis limits. The embedded
+	// memory limiter of FailFallback divides the limits by it, default is 1.
+	FallbackInstances int
+
+	Timeout time.Duration // The timeout of every redis call, default is no timeout.
+	// BreakerThreshold is the count of consecutive redis errors to open the circuit breaker,
+	// default is 0 to disable it, or 1 for FailFallback.
+	BreakerThreshold int
+	// BreakerSuccesses is the count of successful probes to close a half-open breaker, default is 1.
+	BreakerSuccesses int
+	// ProbeInterval is how long an open breaker skips redis before it's half-open, default is
+	// 5 seconds.
+	ProbeInterval time.Duration
+	// OnBreakerChange is called with every transition of the breaker state, for alerting.
+	OnBreakerChange func(from, to BreakerState)
+	// OnFailure is called with every backend error handled by FailureMode, for reporting.
+	OnFailure func(ctx context.Context, key string, err error)
 }
 
 // Result of limiter.Get
 type Result struct {
-	Total     int           // It Equals Options.Max, or policy max
-	Remaining int           // It will always >= -1
-	Duration  time.Duration // It Equals Options.Duration, or policy duration
-	Reset     time.Time     // The limit record reset time
+	Total      int           // It Equals Options.Max, or policy max
+	Remaining  int           // It will always >= -1
+	Duration   time.Duration // It Equals Options.Duration, or policy duration
+	Reset      time.Time     // The limit record reset time, in the redis server time with Options.ServerTime
+	Delay      time.Duration // The time to wait before the request slot, only for LeakyBucket
+	Allowed    bool          // Whether the request is permitted, it equals Remaining >= 0
+	RetryAfter time.Duration // The time to wait before the refused request can be permitted, 0 if allowed
+	Tier       int           // The index of the active policy tier, only FixedWindow escalates it
+	Key        string        // The evaluated key, with Options.Prefix
+	Degraded   bool          // The result is synthetic or from Options.Fallback because the backend errored
+	now        time.Time     // The redis server time of Options.ServerTime, for RetryAfter
 }
 
 // New returns a Limiter instance with given options.
-// If options.Client omit, the limiter is a memory limiter
+// If options.Client omit, the limiter is a memory limiter.
+// A non-positive Max or Duration is replaced by the default, and a Duration under 1ms is rounded
+// up to 1ms. It panics if the other options are invalid or the redis scripts can't be loaded, use
+// NewWithError to validate the options strictly and handle the errors.
 func New(opts Options) *Limiter {
+	if opts.Max < 0 {
+		opts.Max = 0
+	}
+	if opts.Duration < 0 {
+		opts.Duration = 0
+	} else if opts.Duration > 0 && opts.Duration < time.Millisecond {
+		opts.Duration = time.Millisecond
+	}
+	limiter, err := NewWithError(opts)
+	if err != nil {
+		panic(err)
+	}
+	return limiter
+}
+
+// NewWithError returns a Limiter instance with given options, or an error if the options are
+// invalid or the redis scripts can't be loaded. With Options.LazyLoad, the scripts are loaded
+// on the first call instead, and it never returns a backend error.
+/*
+NewWithError starts even if redis is briefly unreachable:
+
+    limiter, err := ratelimiter.NewWithError(ratelimiter.Options{
+        Client:   &redisClient{client},
+        LazyLoad: true,
+    })
+    if err != nil {
+        log.Fatal(err) // invalid options
+    }
+*/
+func NewWithError(opts Options) (*Limiter, error) {
+	if err := opts.init(); err != nil {
+		return nil, err
+	}
+	var store Store
+	switch {
+	case opts.Store != nil:
+		store = opts.Store
+	case opts.Client != nil:
+		r, err := newRedisStore(&opts)
+		if err != nil {
+			return nil, err
+		}
+		store = r
+	default:
+		return newLimiter(newMemoryStore(&opts), &opts), nil
+	}
+	l := newLimiter(store, &opts)
+	if opts.FailureMode == FailFallback && l.fallback == nil {
+		fallback := Options{
+			Ctx:       opts.Ctx,
+			Max:       (opts.Max + opts.FallbackInstances - 1) / opts.FallbackInstances,
+			Duration:  opts.Duration,
+			Prefix:    opts.Prefix,
+			Algorithm: opts.Algorithm,
+			Shards:    opts.Shards,
+			MaxKeys:   opts.MaxKeys,
+			Clock:     opts.Clock,
+		}
+		l.fallback = newLimiter(newMemoryStore(&fallback), &fallback)
+		l.instances = opts.FallbackInstances
+		l.embedded = true
+	}
+	return l, nil
+}
+
+// init validates the options, and replaces zero values by defaults.
+func (opts *Options) init() error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
 	if opts.Prefix == "" {
 		opts.Prefix = "LIMIT:"
 	}
-	if opts.Max <= 0 {
+	if opts.Max == 0 {
 		opts.Max = 100
 	}
-	if opts.Duration <= 0 {
+	if opts.Duration == 0 {
 		opts.Duration = time.Minute
 	}
-	if opts.Client == nil {
-		return newMemoryLimiter(&opts)
+	if opts.Shards == 0 {
+		opts.Shards = 16
+	}
+	if opts.FallbackInstances == 0 {
+		opts.FallbackInstances = 1
+	}
+	if opts.BreakerThreshold == 0 && opts.FailureMode == FailFallback {
+		opts.BreakerThreshold = 1
+	}
+	if opts.BreakerSuccesses == 0 {
+		opts.BreakerSuccesses = 1
 	}
-	return newRedisLimiter(&opts)
+	if opts.ProbeInterval == 0 {
+		opts.ProbeInterval = 5 * time.Second
+	}
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+	return nil
 }
 
-type abstractLimiter interface {
-	getLimit(ctx context.Context, key string, policy ...int) ([]interface{}, error)
-	removeLimit(ctx context.Context, key string) error
+// validate reports whether the options are valid, zero values are replaced by defaults.
+func (opts *Options) validate() error {
+	if opts.Max < 0 {
+		return fmt.Errorf("%w: negative Max %d", ErrInvalidOptions, opts.Max)
+	}
+	if opts.Duration < 0 || (opts.Duration > 0 && opts.Duration < time.Millisecond) {
+		return fmt.Errorf("%w: Duration %v must be at least 1ms", ErrInvalidOptions, opts.Duration)
+	}
+	if opts.Algorithm < FixedWindow || opts.Algorithm > LeakyBucket {
+		return fmt.Errorf("%w: unknown %v", ErrInvalidOptions, opts.Algorithm)
+	}
+	if opts.FailureMode < FailError || opts.FailureMode > FailFallback {
+		return fmt.Errorf("%w: unknown %v", ErrInvalidOptions, opts.FailureMode)
+	}
+	if opts.Shards < 0 || opts.MaxKeys < 0 {
+		return fmt.Errorf("%w: negative Shards or MaxKeys", ErrInvalidOptions)
+	}
+	if opts.FallbackInstances < 0 {
+		return fmt.Errorf("%w: negative FallbackInstances %d", ErrInvalidOptions, opts.FallbackInstances)
+	}
+	if opts.Timeout < 0 || opts.ProbeInterval < 0 {
+		return fmt.Errorf("%w: negative Timeout or ProbeInterval", ErrInvalidOptions)
+	}
+	if opts.BreakerThreshold < 0 || opts.BreakerSuccesses < 0 {
+		return fmt.Errorf("%w: negative BreakerThreshold or BreakerSuccesses", ErrInvalidOptions)
+	}
+	if opts.Client != nil && opts.Store != nil {
+		return fmt.Errorf("%w: both Client and Store", ErrInvalidOptions)
+	}
+	return nil
 }
 
-func newRedisLimiter(opts *Options) *Limiter {
-	sha1, err := opts.Client.RateScriptLoad(opts.Ctx, lua)
-	if err != nil {
-		panic(err)
+func newLimiter(store Store, opts *Options) *Limiter {
+	return &Limiter{
+		store:       store,
+		prefix:      opts.Prefix,
+		algorithm:   opts.Algorithm,
+		max:         opts.Max,
+		duration:    opts.Duration,
+		failureMode: opts.FailureMode,
+		onFailure:   opts.OnFailure,
+		fallback:    opts.Fallback,
+		instances:   1,
+		clock:       opts.Clock,
+		ctx:         opts.Ctx,
+		done:        make(chan struct{}),
+	}
+}
+
+// NewRedisStore returns the Store of a redis limiter with given options, e.g. to wrap it in a
+// custom Store. The options of the Limiter, e.g. Prefix and FailureMode, are ignored.
+func NewRedisStore(opts Options) (Store, error) {
+	if opts.Client == nil {
+		return nil, fmt.Errorf("%w: no Client", ErrInvalidOptions)
+	}
+	if err := opts.init(); err != nil {
+		return nil, err
+	}
+	return newRedisStore(&opts)
+}
+
+func newRedisStore(opts *Options) (*redisLimiter, error) {
+	script, peekScript, refundScript := opts.Algorithm.script(), peekLua, refundLua
+	if opts.ServerTime {
+		script, peekScript, refundScript = serverTime(script), serverTime(peekScript), serverTime(refundScript)
 	}
 	r := &redisLimiter{
-		rc:       opts.Client,
-		sha1:     sha1,
-		max:      strconv.FormatInt(int64(opts.Max), 10),
-		duration: strconv.FormatInt(int64(opts.Duration/time.Millisecond), 10),
+		rc:           opts.Client,
+		script:       script,
+		sha1:         scriptSha1(script),
+		peekScript:   peekScript,
+		peekSha1:     scriptSha1(peekScript),
+		refundScript: refundScript,
+		refundSha1:   scriptSha1(refundScript),
+		algorithm:    opts.Algorithm.String(),
+		max:          opts.Max,
+		duration:     opts.Duration,
+		timeout:      opts.Timeout,
+		clock:        opts.Clock,
 	}
-	return &Limiter{r, opts.Prefix}
+	if opts.BreakerThreshold > 0 {
+		r.breaker = &breaker{
+			threshold: opts.BreakerThreshold,
+			successes: opts.BreakerSuccesses,
+			interval:  opts.ProbeInterval,
+			onChange:  opts.OnBreakerChange,
+			clock:     opts.Clock,
+		}
+	}
+	if !opts.LazyLoad {
+		ctx := opts.Ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		for _, script := range []string{r.script, r.peekScript, r.refundScript} {
+			if err := r.load(ctx, script); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, nil
 }
 
 // Get get a limiter result for id. support custom limiter policy.
@@ -149,25 +444,164 @@ Get get a limiter result with custom limiter policy:
     res, err := limiter.Get(id, policy...)
 */
 func (l *Limiter) Get(ctx context.Context, id string, policy ...int) (Result, error) {
+	return l.GetN(ctx, id, 1, policy...)
+}
+
+// GetN get a limiter result for id, consuming cost units at once. support custom limiter policy.
+// If the remaining units are insufficient, Remaining is -1 and nothing is consumed.
+/*
+GetN consumes the uploaded size from a 10MB per minute quota:
+
+    policy := []int{10 << 20, 60000}
+    res, err := limiter.GetN(ctx, userID, len(body), policy...)
+    if err == nil && res.Remaining >= 0 {
+        // accept the upload
+    }
+*/
+func (l *Limiter) GetN(ctx context.Context, id string, cost int, policy ...int) (Result, error) {
+	p, err := NewPolicy(policy...)
+	if err != nil {
+		return Result{}, err
+	}
+	return l.GetNPolicy(ctx, id, cost, p)
+}
+
+// GetPolicy get a limiter result for id with a typed Policy.
+/*
+GetPolicy get a limiter result with a parsed policy:
+
+    policy, err := ratelimiter.ParsePolicy("100/1m,50/1m,50/2m")
+    if err != nil {
+        return err
+    }
+    res, err := limiter.GetPolicy(ctx, id, policy)
+*/
+func (l *Limiter) GetPolicy(ctx context.Context, id string, policy Policy) (Result, error) {
+	return l.GetNPolicy(ctx, id, 1, policy)
+}
+
+// GetNPolicy get a limiter result for id with a typed Policy, consuming cost units at once.
+func (l *Limiter) GetNPolicy(ctx context.Context, id string, cost int, policy Policy) (Result, error) {
+	result, _, err := l.take(ctx, id, cost, policy)
+	return result, err
+}
+
+// take consumes cost units for id, and returns the result with the time it's taken at, which is
+// the redis server time with Options.ServerTime.
+func (l *Limiter) take(ctx context.Context, id string, cost int, policy Policy) (Result, time.Time, error) {
 	var result Result
 	key := l.prefix + id
+	at := l.clock.Now()
 
-	if odd := len(policy) % 2; odd == 1 {
-		return result, errors.New("ratelimiter: must be paired values")
+	if err := l.closed(); err != nil {
+		return result, at, err
+	}
+	if err := policy.Validate(); err != nil {
+		return result, at, err
+	}
+	if cost <= 0 {
+		return result, at, policyError("ratelimiter: must be positive integer")
 	}
 
-	res, err := l.getLimit(ctx, key, policy...)
+	res, err := l.store.Take(ctx, key, cost, l.policy(policy))
 	if err != nil {
+		result, err = l.fail(ctx, id, cost, policy, false, err)
+		return result, at, err
+	}
+	if !res.now.IsZero() {
+		at = res.now
+	}
+	return l.result(res, key, cost, false), at, nil
+}
+
+// Peek get the current limiter result for id without consuming it. support custom limiter policy.
+// Remaining is the count still allowed, and it is Total with Reset now if no record exists.
+// Allowed and RetryAfter are for a request of one unit made now.
+/*
+Peek shows the remaining quota on a dashboard:
+
+    res, err := limiter.Peek(ctx, userID)
+    if err == nil {
+        fmt.Println(res.Remaining) // 100
+    }
+*/
+func (l *Limiter) Peek(ctx context.Context, id string, policy ...int) (Result, error) {
+	p, err := NewPolicy(policy...)
+	if err != nil {
+		return Result{}, err
+	}
+	return l.PeekPolicy(ctx, id, p)
+}
+
+// PeekPolicy get the current limiter result for id with a typed Policy without consuming it.
+func (l *Limiter) PeekPolicy(ctx context.Context, id string, policy Policy) (Result, error) {
+	var result Result
+	key := l.prefix + id
+
+	if err := l.closed(); err != nil {
+		return result, err
+	}
+	if err := policy.Validate(); err != nil {
 		return result, err
 	}
 
-	result = Result{}
+	res, err := l.store.Peek(ctx, key, l.policy(policy))
+	if err != nil {
+		return l.fail(ctx, id, 1, policy, true, err)
+	}
+	return l.result(res, key, 1, true), nil
+}
+
+// policy returns policy, or the tier of Options.Max and Options.Duration if it's empty.
+func (l *Limiter) policy(policy Policy) Policy {
+	if len(policy) == 0 {
+		return Policy{{Max: l.max, Duration: l.duration}}
+	}
+	return policy
+}
+
+// result returns the Result of a Store for key, with the decision fields of a request consuming
+// cost units. For a peek, Allowed reports whether the request would be permitted now.
+func (l *Limiter) result(result Result, key string, cost int, peek bool) Result {
+	result.Key = key
+	if peek {
+		result.Allowed = result.Remaining >= cost
+	} else {
+		result.Allowed = result.Remaining >= 0
+	}
+	if !result.Allowed {
+		now := result.now
+		if now.IsZero() {
+			now = l.clock.Now()
+		}
+		reset := result.Reset
+		switch l.algorithm {
+		case TokenBucket, GCRA, LeakyBucket:
+			// Reset is the time the bucket is full, cost units are available earlier
+			if free := result.Total - cost; free > 0 {
+				reset = reset.Add(-result.Duration * time.Duration(free) / time.Duration(result.Total))
+			}
+		}
+		if wait := reset.Sub(now); wait > 0 {
+			result.RetryAfter = wait
+		}
+	}
+	result.now = time.Time{}
+	return result
+}
+
+func parseResult(res []interface{}) Result {
+	result := Result{}
 	switch res[3].(type) {
 	case time.Time: // result from memory limiter
 		result.Remaining = res[0].(int)
 		result.Total = res[1].(int)
 		result.Duration = res[2].(time.Duration)
 		result.Reset = res[3].(time.Time)
+		result.Delay = res[4].(time.Duration)
+		if len(res) > 5 && res[5].(int) > 0 {
+			result.Tier = res[5].(int) - 1
+		}
 	default: // result from redis limiter
 		result.Remaining = int(res[0].(int64))
 		result.Total = int(res[1].(int64))
@@ -176,70 +610,315 @@ func (l *Limiter) Get(ctx context.Context, id string, policy ...int) (Result, er
 		timestamp := res[3].(int64)
 		sec := timestamp / 1000
 		result.Reset = time.Unix(sec, (timestamp-(sec*1000))*1e6)
+		if len(res) > 4 {
+			result.Delay = time.Duration(res[4].(int64)) * time.Millisecond
+		}
+		if len(res) > 5 && res[5].(int64) > 0 {
+			result.Tier = int(res[5].(int64)) - 1
+		}
+		if len(res) > 6 {
+			// the server timestamp of Options.ServerTime, Reset is based on it
+			result.now = time.Unix(0, res[6].(int64)*1e6)
+		}
+	}
+	return result
+}
+
+// Wait blocks until a request for id is permitted, or ctx is done. support custom limiter policy.
+// It fails fast with ErrWaitExceedsDeadline without waiting if the limit resets after the ctx
+// deadline.
+/*
+Wait paces a batch worker:
+
+    for _, job := range jobs {
+        if err := limiter.Wait(ctx, "batch-worker"); err != nil {
+            return err
+        }
+        job.Run()
+    }
+*/
+func (l *Limiter) Wait(ctx context.Context, id string, policy ...int) error {
+	return l.WaitN(ctx, id, 1, policy...)
+}
+
+// WaitN blocks until cost units for id are consumed, or ctx is done. support custom limiter policy.
+// For LeakyBucket, it also waits for the scheduled slot, which is refunded if it fails.
+func (l *Limiter) WaitN(ctx context.Context, id string, cost int, policy ...int) error {
+	p, err := NewPolicy(policy...)
+	if err != nil {
+		return err
+	}
+	return l.WaitNPolicy(ctx, id, cost, p)
+}
+
+// WaitNPolicy blocks until cost units for id with a typed Policy are consumed, or ctx is done.
+// It fails with ErrInvalidPolicy if cost exceeds the limit.
+func (l *Limiter) WaitNPolicy(ctx context.Context, id string, cost int, policy Policy) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		r, err := l.ReserveNPolicy(ctx, id, cost, policy)
+		if err != nil {
+			return err
+		}
+		res := r.Result
+		if !res.Allowed && cost > res.Total {
+			// it would never be permitted
+			return policyError("ratelimiter: cost exceeds the limit")
+		}
+
+		var wait time.Duration
+		if res.Allowed {
+			if res.Delay <= 0 {
+				return nil
+			}
+			wait = res.Delay
+		} else {
+			wait = res.RetryAfter
+			if wait < time.Millisecond {
+				wait = time.Millisecond
+			}
+		}
+		if deadline, ok := ctx.Deadline(); ok && l.clock.Now().Add(wait).After(deadline) {
+			// a LeakyBucket slot is refunded, so the queue is not pushed out by failed calls
+			r.Cancel(context.Background())
+			return fmt.Errorf("%w: retry after %v", ErrWaitExceedsDeadline, wait)
+		}
+
+		timer := l.clock.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			r.Cancel(context.Background())
+			return ctx.Err()
+		case <-timer.C():
+		}
+		if res.Allowed {
+			return nil
+		}
 	}
-	return result, nil
 }
 
 // Remove remove limiter record for id
 func (l *Limiter) Remove(ctx context.Context, id string) error {
-	return l.removeLimit(ctx, l.prefix+id)
+	if err := l.closed(); err != nil {
+		return err
+	}
+	return l.store.Remove(ctx, l.prefix+id)
+}
+
+// Close closes the limiter and releases its resources, e.g. the cleanup goroutine of a memory
+// limiter. Every call of a closed limiter returns ErrClosed. It's also closed when Options.Ctx
+// is done.
+func (l *Limiter) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.store.Close()
+		if l.embedded {
+			l.fallback.Close()
+		}
+	})
+	return err
+}
+
+// closed returns ErrClosed if the limiter is closed.
+func (l *Limiter) closed() error {
+	select {
+	case <-l.done:
+		return ErrClosed
+	default:
+	}
+	if l.ctx != nil && l.ctx.Err() != nil {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Evictions returns the count of keys evicted by Options.MaxKeys, it's always 0 for a redis
+// limiter.
+func (l *Limiter) Evictions() uint64 {
+	if m, ok := l.store.(*memoryLimiter); ok {
+		return m.evictions()
+	}
+	return 0
+}
+
+// BreakerState returns the state of the circuit breaker around the redis client, it's always
+// BreakerClosed for a memory limiter or a disabled breaker.
+func (l *Limiter) BreakerState() BreakerState {
+	if r, ok := l.store.(*redisLimiter); ok {
+		return r.breaker.State()
+	}
+	return BreakerClosed
 }
 
 type redisLimiter struct {
-	sha1, max, duration string
-	rc                  RedisClient
+	sha1, script             string
+	max                      int
+	duration                 time.Duration
+	peekSha1, peekScript     string
+	refundSha1, refundScript string
+	algorithm                string
+	rc                       RedisClient
+	timeout                  time.Duration
+	breaker                  *breaker
+	clock                    Clock
 }
 
-func (r *redisLimiter) removeLimit(ctx context.Context, key string) error {
-	return r.rc.RateDel(ctx, key)
+// Close implements Store.
+func (r *redisLimiter) Close() error {
+	return nil
 }
 
-func (r *redisLimiter) getLimit(ctx context.Context, key string, policy ...int) ([]interface{}, error) {
-	keys := []string{key, fmt.Sprintf("{%s}:S", key)}
-	capacity := 3
-	length := len(policy)
-	if length > 2 {
-		capacity = length + 1
+// Remove implements Store.
+func (r *redisLimiter) Remove(ctx context.Context, key string) error {
+	callCtx, cancel := r.context(ctx)
+	defer cancel()
+	if err := r.rc.RateDel(callCtx, key); err != nil {
+		return &BackendError{"del", err}
 	}
+	return nil
+}
+
+// Take implements Store.
+func (r *redisLimiter) Take(ctx context.Context, key string, cost int, policy Policy) (Result, error) {
+	args := r.args([]interface{}{strconv.FormatInt(int64(cost), 10)}, policy)
+	return r.evalLimit(ctx, r.sha1, r.script, key, args...)
+}
+
+// Peek implements Store.
+func (r *redisLimiter) Peek(ctx context.Context, key string, policy Policy) (Result, error) {
+	args := r.args([]interface{}{r.algorithm}, policy)
+	return r.evalLimit(ctx, r.peekSha1, r.peekScript, key, args...)
+}
 
-	args := make([]interface{}, capacity, capacity)
-	args[0] = genTimestamp()
-	if length == 0 {
-		args[1] = r.max
-		args[2] = r.duration
+// Refund implements Store.
+func (r *redisLimiter) Refund(ctx context.Context, key string, cost int, at, reset time.Time, policy Policy) (bool, error) {
+	args := r.args([]interface{}{
+		r.algorithm,
+		strconv.FormatInt(int64(cost), 10),
+		strconv.FormatInt(at.UnixNano()/1e6, 10),
+		strconv.FormatInt(reset.UnixNano()/1e6, 10),
+	}, policy)
+	res, err := r.eval(ctx, r.refundSha1, r.refundScript, key, args...)
+	if err != nil {
+		return false, err
+	}
+	refunded, ok := res.(int64)
+	if !ok {
+		return false, ErrInvalidResponse
+	}
+	return refunded == 1, nil
+}
+
+// args returns script arguments: current timestamp, the given arguments and policy.
+func (r *redisLimiter) args(extra []interface{}, policy Policy) []interface{} {
+	values := policy.ints(r.max, r.duration)
+	offset := len(extra) + 1
+	args := make([]interface{}, offset+len(values))
+	args[0] = genTimestamp(r.clock.Now())
+	copy(args[1:], extra)
+	for i, val := range values {
+		args[i+offset] = strconv.FormatInt(int64(val), 10)
+	}
+	return args
+}
+
+func (r *redisLimiter) eval(ctx context.Context, sha1, script, key string, args ...interface{}) (interface{}, error) {
+	if !r.breaker.allow() {
+		return nil, &BackendError{"evalsha", ErrCircuitOpen}
+	}
+	res, err := r.evalSha(ctx, sha1, script, key, args...)
+	if err != nil && ctx.Err() != nil {
+		// canceled by the caller, it's not a redis failure
+		r.breaker.release()
 	} else {
-		for i, val := range policy {
-			if val <= 0 {
-				return nil, errors.New("ratelimiter: must be positive integer")
-			}
-			args[i+1] = strconv.FormatInt(int64(val), 10)
-		}
+		r.breaker.done(err != nil)
 	}
+	return res, err
+}
 
-	res, err := r.rc.RateEvalSha(ctx, r.sha1, keys, args...)
+func (r *redisLimiter) evalSha(ctx context.Context, sha1, script, key string, args ...interface{}) (interface{}, error) {
+	keys := []string{key, fmt.Sprintf("{%s}:S", key)}
+	callCtx, cancel := r.context(ctx)
+	res, err := r.rc.RateEvalSha(callCtx, sha1, keys, args...)
+	cancel()
 	if err != nil && isNoScriptErr(err) {
 		// try to load lua for cluster client and ring client for nodes changing.
-		_, err = r.rc.RateScriptLoad(ctx, lua)
-		if err == nil {
-			res, err = r.rc.RateEvalSha(ctx, r.sha1, keys, args...)
+		if err = r.load(ctx, script); err != nil {
+			return nil, err
 		}
+		callCtx, cancel = r.context(ctx)
+		res, err = r.rc.RateEvalSha(callCtx, sha1, keys, args...)
+		cancel()
+	}
+	if err != nil {
+		return nil, &BackendError{"evalsha", err}
 	}
+	return res, nil
+}
+
+func (r *redisLimiter) load(ctx context.Context, script string) error {
+	callCtx, cancel := r.context(ctx)
+	defer cancel()
+	if _, err := r.rc.RateScriptLoad(callCtx, script); err != nil {
+		return &BackendError{"script load", err}
+	}
+	return nil
+}
 
-	if err == nil {
-		arr, ok := res.([]interface{})
-		if ok && len(arr) == 4 {
-			return arr, nil
+// context returns ctx with Options.Timeout for a redis call.
+func (r *redisLimiter) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, r.timeout)
+}
+
+func (r *redisLimiter) evalLimit(ctx context.Context, sha1, script, key string, args ...interface{}) (Result, error) {
+	res, err := r.eval(ctx, sha1, script, key, args...)
+	if err != nil {
+		return Result{}, err
+	}
+	arr, ok := res.([]interface{})
+	if !ok || len(arr) < 4 || len(arr) > 7 {
+		return Result{}, ErrInvalidResponse
+	}
+	for _, v := range arr {
+		if _, ok := v.(int64); !ok {
+			return Result{}, ErrInvalidResponse
 		}
-		err = errors.New("Invalid result")
 	}
-	return nil, err
+	return parseResult(arr), nil
 }
 
-func genTimestamp() string {
-	now := time.Now().UnixNano() / 1e6
+func genTimestamp(t time.Time) string {
+	now := t.UnixNano() / 1e6
 	return strconv.FormatInt(now, 10)
 }
 
+// init registers the emulated scripts' digests with internal/scripts.
+func init() {
+	for name, script := range map[string]string{
+		scripts.FixedWindow: lua,
+		scripts.Peek:        peekLua,
+		scripts.Refund:      refundLua,
+	} {
+		scripts.Register(name, scripts.Digests{Sha1: scriptSha1(script), ServerTimeSha1: scriptSha1(serverTime(script))})
+	}
+}
+
+// scriptSha1 returns the sha1 digest of a script, as redis SCRIPT LOAD does.
+func scriptSha1(script string) string {
+	sum := sha1.Sum([]byte(script))
+	return hex.EncodeToString(sum[:])
+}
+
 func isNoScriptErr(err error) bool {
 	return strings.HasPrefix(err.Error(), "NOSCRIPT ")
 }
@@ -248,38 +927,44 @@ func isNoScriptErr(err error) bool {
 const lua string = `
 -- KEYS[1] target hash key
 -- KEYS[2] target status hash key
--- ARGV[n >= 3] current timestamp, max count, duration, max count, duration, ...
+-- ARGV[n >= 4] current timestamp, cost, max count, duration, max count, duration, ...
 
 -- HASH: KEYS[1]
 --   field:ct(count)
 --   field:lt(limit)
 --   field:dn(duration)
 --   field:rt(reset)
+--   field:ix(policy index)
 
 local res = {}
-local policyCount = (#ARGV - 1) / 2
-local limit = redis.call('hmget', KEYS[1], 'ct', 'lt', 'dn', 'rt')
+local cost = tonumber(ARGV[2])
+local policyCount = (#ARGV - 2) / 2
+local limit = redis.call('hmget', KEYS[1], 'ct', 'lt', 'dn', 'rt', 'ix')
 
 if limit[1] then
 
-  res[1] = tonumber(limit[1]) - 1
+  local count = tonumber(limit[1])
   res[2] = tonumber(limit[2])
-  res[3] = tonumber(limit[3]) or ARGV[3]
+  res[3] = tonumber(limit[3]) or ARGV[4]
   res[4] = tonumber(limit[4])
+  res[6] = tonumber(limit[5]) or 1
 
-  if policyCount > 1 and res[1] == -1 then
-    redis.call('incr', KEYS[2])
-    redis.call('pexpire', KEYS[2], res[3] * 2)
-    local index = tonumber(redis.call('get', KEYS[2]))
-    if index == 1 then
-      redis.call('incr', KEYS[2])
-    end
-  end
-
-  if res[1] >= -1 then
-    redis.call('hincrby', KEYS[1], 'ct', -1)
+  if count >= cost then
+    res[1] = count - cost
+    redis.call('hincrby', KEYS[1], 'ct', -cost)
   else
     res[1] = -1
+    if count == 0 then
+      if policyCount > 1 then
+        redis.call('incr', KEYS[2])
+        redis.call('pexpire', KEYS[2], res[3] * 2)
+        local index = tonumber(redis.call('get', KEYS[2]))
+        if index == 1 then
+          redis.call('incr', KEYS[2])
+        end
+      end
+      redis.call('hincrby', KEYS[1], 'ct', -1)
+    end
   end
 
 else
@@ -292,16 +977,24 @@ else
     end
   end
 
-  local total = tonumber(ARGV[index * 2])
-  res[1] = total - 1
+  local total = tonumber(ARGV[index * 2 + 1])
+  local count = total
+  if total >= cost then
+    count = total - cost
+    res[1] = count
+  else
+    res[1] = -1
+  end
   res[2] = total
-  res[3] = tonumber(ARGV[index * 2 + 1])
+  res[3] = tonumber(ARGV[index * 2 + 2])
   res[4] = tonumber(ARGV[1]) + res[3]
+  res[6] = index
 
-  redis.call('hmset', KEYS[1], 'ct', res[1], 'lt', res[2], 'dn', res[3], 'rt', res[4])
+  redis.call('hmset', KEYS[1], 'ct', count, 'lt', res[2], 'dn', res[3], 'rt', res[4], 'ix', index)
   redis.call('pexpire', KEYS[1], res[3])
 
 end
 
+res[5] = 0
 return res
 `
@@ -1,37 +1,43 @@
 -- KEYS[1] target hash key
 -- KEYS[2] target status hash key
--- ARGV[n >= 3] current timestamp, max count, duration, max count, duration, ...
+-- ARGV[n >= 4] current timestamp, cost, max count, duration, max count, duration, ...
 
 -- HASH: KEYS[1]
 --   field:ct(count)
 --   field:lt(limit)
 --   field:dn(duration)
 --   field:rt(reset)
+--   field:ix(policy index)
 
 local res = {}
-local policyCount = (#ARGV - 1) / 2
-local limit = redis.call('hmget', KEYS[1], 'ct', 'lt', 'dn', 'rt')
+local cost = tonumber(ARGV[2])
+local policyCount = (#ARGV - 2) / 2
+local limit = redis.call('hmget', KEYS[1], 'ct', 'lt', 'dn', 'rt', 'ix')
 
 if limit[1] then
 
-  res[1] = tonumber(limit[1]) - 1
+  local count = tonumber(limit[1])
   res[2] = tonumber(limit[2])
-  res[3] = tonumber(limit[3]) or ARGV[3]
+  res[3] = tonumber(limit[3]) or ARGV[4]
   res[4] = tonumber(limit[4])
+  res[6] = tonumber(limit[5]) or 1
 
-  if policyCount > 1 and res[1] == -1 then
-    redis.call('incr', KEYS[2])
-    redis.call('pexpire', KEYS[2], res[3] * 2)
-    local index = tonumber(redis.call('get', KEYS[2]))
-    if index == 1 then
-      redis.call('incr', KEYS[2])
-    end
-  end
-
-  if res[1] >= -1 then
-    redis.call('hincrby', KEYS[1], 'ct', -1)
+  if count >= cost then
+    res[1] = count - cost
+    redis.call('hincrby', KEYS[1], 'ct', -cost)
   else
     res[1] = -1
+    if count == 0 then
+      if policyCount > 1 then
+        redis.call('incr', KEYS[2])
+        redis.call('pexpire', KEYS[2], res[3] * 2)
+        local index = tonumber(redis.call('get', KEYS[2]))
+        if index == 1 then
+          redis.call('incr', KEYS[2])
+        end
+      end
+      redis.call('hincrby', KEYS[1], 'ct', -1)
+    end
   end
 
 else
@@ -44,15 +50,23 @@ else
     end
   end
 
-  local total = tonumber(ARGV[index * 2])
-  res[1] = total - 1
+  local total = tonumber(ARGV[index * 2 + 1])
+  local count = total
+  if total >= cost then
+    count = total - cost
+    res[1] = count
+  else
+    res[1] = -1
+  end
   res[2] = total
-  res[3] = tonumber(ARGV[index * 2 + 1])
+  res[3] = tonumber(ARGV[index * 2 + 2])
   res[4] = tonumber(ARGV[1]) + res[3]
+  res[6] = index
 
-  redis.call('hmset', KEYS[1], 'ct', res[1], 'lt', res[2], 'dn', res[3], 'rt', res[4])
+  redis.call('hmset', KEYS[1], 'ct', count, 'lt', res[2], 'dn', res[3], 'rt', res[4], 'ix', index)
   redis.call('pexpire', KEYS[1], res[3])
 
 end
 
+res[5] = 0
 return res
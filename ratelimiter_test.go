@@ -3,14 +3,19 @@ package ratelimiter_test
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha1"
 	"encoding/hex"
 	"errors"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	ratelimiter "github.com/ilam01/limits-go"
+	"github.com/ilam01/limits-go/internal/scripts"
+	"github.com/ilam01/limits-go/ratelimitertest"
 
 	"github.com/go-redis/redis/v8"
 
@@ -26,7 +31,7 @@ func (c *redisFailedClient) RateDel(ctx context.Context, key string) error {
 	return c.Del(ctx, key).Err()
 }
 
-func (c *redisFailedClient) RateEvalSha(sha1 string, keys []string, args ...interface{}) (interface{}, error) {
+func (c *redisFailedClient) RateEvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) (interface{}, error) {
 	return nil, errors.New("NOSCRIPT mock error")
 }
 
@@ -107,7 +112,9 @@ func TestRedisRatelimiter(t *testing.T) {
 	})
 	ctx := context.Background()
 	pong, err := client.Ping(context.Background()).Result()
-	assert.Nil(t, err)
+	if err != nil {
+		t.Skipf("redis is not available: %v", err)
+	}
 	assert.Equal(t, "PONG", pong)
 	defer client.Close()
 
@@ -777,6 +784,420 @@ func TestRedisRatelimiter(t *testing.T) {
 			}
 		})
 	})
+	t.Run("ratelimiter.New with TokenBucket", func(t *testing.T) {
+		assert := assert.New(t)
+
+		var id = genID()
+		limiter := ratelimiter.New(ratelimiter.Options{
+			Client:    &redisClient{client},
+			Algorithm: ratelimiter.TokenBucket,
+		})
+		policy := []int{3, 300}
+
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(3, res.Total)
+		assert.Equal(2, res.Remaining)
+		assert.Equal(300*time.Millisecond, res.Duration)
+		assert.True(res.Reset.After(time.Now()))
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(1, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+
+		// one token is refilled every 100ms
+		time.Sleep(100*time.Millisecond + time.Millisecond)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+
+		err = limiter.Remove(ctx, id)
+		assert.Nil(err)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(2, res.Remaining)
+	})
+	t.Run("ratelimiter.New with GCRA", func(t *testing.T) {
+		assert := assert.New(t)
+
+		var id = genID()
+		limiter := ratelimiter.New(ratelimiter.Options{
+			Client:    &redisClient{client},
+			Algorithm: ratelimiter.GCRA,
+		})
+		policy := []int{3, 300}
+
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(3, res.Total)
+		assert.Equal(2, res.Remaining)
+		assert.Equal(300*time.Millisecond, res.Duration)
+		assert.True(res.Reset.After(time.Now()))
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(1, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+
+		// one request is emitted every 100ms
+		time.Sleep(100*time.Millisecond + time.Millisecond)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+
+		err = limiter.Remove(ctx, id)
+		assert.Nil(err)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(2, res.Remaining)
+	})
+	t.Run("ratelimiter.New with SlidingLog", func(t *testing.T) {
+		assert := assert.New(t)
+
+		var id = genID()
+		limiter := ratelimiter.New(ratelimiter.Options{
+			Client:    &redisClient{client},
+			Algorithm: ratelimiter.SlidingLog,
+		})
+		policy := []int{2, 200}
+
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(2, res.Total)
+		assert.Equal(1, res.Remaining)
+		assert.Equal(200*time.Millisecond, res.Duration)
+
+		time.Sleep(100 * time.Millisecond)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+
+		time.Sleep(res.Reset.Sub(time.Now()) + time.Millisecond)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+
+		err = limiter.Remove(ctx, id)
+		assert.Nil(err)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(1, res.Remaining)
+	})
+	t.Run("ratelimiter.New with SlidingWindow", func(t *testing.T) {
+		assert := assert.New(t)
+
+		var id = genID()
+		limiter := ratelimiter.New(ratelimiter.Options{
+			Client:    &redisClient{client},
+			Algorithm: ratelimiter.SlidingWindow,
+		})
+		policy := []int{3, 200}
+		waitWindow := func(offset time.Duration) {
+			elapsed := time.Duration(time.Now().UnixNano()) % (200 * time.Millisecond)
+			time.Sleep(200*time.Millisecond - elapsed + offset)
+		}
+
+		waitWindow(5 * time.Millisecond)
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(3, res.Total)
+		assert.Equal(2, res.Remaining)
+		assert.Equal(200*time.Millisecond, res.Duration)
+		res, err = limiter.Get(ctx, id, policy...)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+
+		// half of the previous window is weighted: 3 * 0.5 + 1 requests
+		waitWindow(100 * time.Millisecond)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+
+		err = limiter.Remove(ctx, id)
+		assert.Nil(err)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(2, res.Remaining)
+	})
+	t.Run("ratelimiter.New with LeakyBucket", func(t *testing.T) {
+		assert := assert.New(t)
+
+		var id = genID()
+		limiter := ratelimiter.New(ratelimiter.Options{
+			Client:    &redisClient{client},
+			Algorithm: ratelimiter.LeakyBucket,
+		})
+		policy := []int{3, 300}
+
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(3, res.Total)
+		assert.Equal(2, res.Remaining)
+		assert.Equal(time.Duration(0), res.Delay)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(1, res.Remaining)
+		assert.True(res.Delay > 90*time.Millisecond && res.Delay <= 100*time.Millisecond)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(0, res.Remaining)
+		assert.True(res.Delay > 190*time.Millisecond && res.Delay <= 200*time.Millisecond)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(-1, res.Remaining)
+		assert.Equal(time.Duration(0), res.Delay)
+
+		err = limiter.Remove(ctx, id)
+		assert.Nil(err)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Equal(2, res.Remaining)
+		assert.Equal(time.Duration(0), res.Delay)
+	})
+	t.Run("limiter.GetN with cost", func(t *testing.T) {
+		algorithms := []ratelimiter.Algorithm{
+			ratelimiter.FixedWindow,
+			ratelimiter.TokenBucket,
+			ratelimiter.GCRA,
+			ratelimiter.SlidingLog,
+			ratelimiter.SlidingWindow,
+			ratelimiter.LeakyBucket,
+		}
+		for _, algorithm := range algorithms {
+			assert := assert.New(t)
+
+			var id = genID()
+			limiter := ratelimiter.New(ratelimiter.Options{
+				Client:    &redisClient{client},
+				Algorithm: algorithm,
+			})
+			policy := []int{5, 3600000}
+
+			res, err := limiter.GetN(ctx, id, 3, policy...)
+			assert.Nil(err)
+			assert.Equal(5, res.Total)
+			assert.Equal(2, res.Remaining)
+
+			// refused without consuming
+			res, err = limiter.GetN(ctx, id, 3, policy...)
+			assert.Nil(err)
+			assert.Equal(-1, res.Remaining)
+
+			res, err = limiter.GetN(ctx, id, 2, policy...)
+			assert.Equal(0, res.Remaining)
+			res, err = limiter.Get(ctx, id, policy...)
+			assert.Equal(-1, res.Remaining)
+
+			res, err = limiter.GetN(ctx, genID(), 6, policy...)
+			assert.Nil(err)
+			assert.Equal(-1, res.Remaining)
+		}
+	})
+	t.Run("limiter.Peek", func(t *testing.T) {
+		algorithms := []ratelimiter.Algorithm{
+			ratelimiter.FixedWindow,
+			ratelimiter.TokenBucket,
+			ratelimiter.GCRA,
+			ratelimiter.SlidingLog,
+			ratelimiter.SlidingWindow,
+			ratelimiter.LeakyBucket,
+		}
+		for _, algorithm := range algorithms {
+			assert := assert.New(t)
+
+			var id = genID()
+			limiter := ratelimiter.New(ratelimiter.Options{
+				Client:    &redisClient{client},
+				Algorithm: algorithm,
+			})
+			policy := []int{3, 3600000}
+
+			res, err := limiter.Peek(ctx, id, policy...)
+			assert.Nil(err)
+			assert.Equal(3, res.Total)
+			assert.Equal(3, res.Remaining)
+			assert.Equal(time.Hour, res.Duration)
+
+			res, err = limiter.Get(ctx, id, policy...)
+			assert.Equal(2, res.Remaining)
+			res, err = limiter.Peek(ctx, id, policy...)
+			assert.Nil(err)
+			assert.Equal(2, res.Remaining)
+			res, err = limiter.Peek(ctx, id, policy...)
+			assert.Equal(2, res.Remaining)
+
+			res, err = limiter.GetN(ctx, id, 2, policy...)
+			res, err = limiter.Get(ctx, id, policy...)
+			assert.Equal(-1, res.Remaining)
+			res, err = limiter.Peek(ctx, id, policy...)
+			assert.Equal(0, res.Remaining)
+		}
+	})
+	t.Run("limiter.GetPolicy", func(t *testing.T) {
+		assert := assert.New(t)
+
+		var id = genID()
+		limiter := ratelimiter.New(ratelimiter.Options{Client: &redisClient{client}})
+		policy, err := ratelimiter.ParsePolicy("2/100ms,1/200ms")
+		assert.Nil(err)
+
+		res, err := limiter.GetPolicy(ctx, id, policy)
+		assert.Nil(err)
+		assert.Equal(2, res.Total)
+		assert.Equal(1, res.Remaining)
+		res, err = limiter.GetPolicy(ctx, id, policy)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.GetPolicy(ctx, id, policy)
+		assert.Equal(-1, res.Remaining)
+
+		time.Sleep(res.Duration + time.Millisecond)
+		res, err = limiter.GetPolicy(ctx, id, policy)
+		assert.Nil(err)
+		assert.Equal(1, res.Total)
+		assert.Equal(0, res.Remaining)
+		assert.Equal(200*time.Millisecond, res.Duration)
+	})
+	t.Run("limiter.Get with decision fields", func(t *testing.T) {
+		assert := assert.New(t)
+
+		var id = genID()
+		limiter := ratelimiter.New(ratelimiter.Options{Client: &redisClient{client}})
+		policy := []int{1, 100, 1, 60000}
+
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.True(res.Allowed)
+		assert.Equal(time.Duration(0), res.RetryAfter)
+		assert.Equal(0, res.Tier)
+		assert.Equal("LIMIT:"+id, res.Key)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.False(res.Allowed)
+		assert.True(res.RetryAfter > 0 && res.RetryAfter <= 100*time.Millisecond)
+
+		time.Sleep(res.Duration + time.Millisecond)
+		res, err = limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.True(res.Allowed)
+		assert.Equal(1, res.Tier)
+		res, err = limiter.Peek(ctx, id, policy...)
+		assert.Nil(err)
+		assert.False(res.Allowed)
+		assert.Equal(1, res.Tier)
+	})
+	t.Run("redis store conformance", func(t *testing.T) {
+		for _, algorithm := range []ratelimiter.Algorithm{ratelimiter.FixedWindow, ratelimiter.TokenBucket,
+			ratelimiter.GCRA, ratelimiter.SlidingLog, ratelimiter.SlidingWindow, ratelimiter.LeakyBucket} {
+			algorithm := algorithm
+			t.Run(algorithm.String(), func(t *testing.T) {
+				ratelimitertest.TestStore(t, func() ratelimiter.Store {
+					store, err := ratelimiter.NewRedisStore(ratelimiter.Options{
+						Client:    &redisClient{client},
+						Algorithm: algorithm,
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+					return store
+				})
+			})
+		}
+	})
+	t.Run("redis limiter conformance", func(t *testing.T) {
+		ratelimitertest.TestLimiterRealTime(t, func(opts ratelimiter.Options) *ratelimiter.Limiter {
+			opts.Client = &redisClient{client}
+			return ratelimiter.New(opts)
+		})
+	})
+	t.Run("limiter.Get with ServerTime", func(t *testing.T) {
+		assert := assert.New(t)
+
+		// the client clock is an hour behind, the server time is used anyway
+		clock := ratelimitertest.NewManualClock(time.Now().Add(-time.Hour))
+		for _, algorithm := range []ratelimiter.Algorithm{ratelimiter.FixedWindow, ratelimiter.TokenBucket,
+			ratelimiter.GCRA, ratelimiter.SlidingLog, ratelimiter.SlidingWindow, ratelimiter.LeakyBucket} {
+			var id = genID()
+			limiter := ratelimiter.New(ratelimiter.Options{
+				Client:     &redisClient{client},
+				Max:        1,
+				Duration:   time.Second,
+				Algorithm:  algorithm,
+				Clock:      clock,
+				ServerTime: true,
+			})
+
+			res, err := limiter.Get(ctx, id)
+			assert.Nil(err, algorithm.String())
+			assert.Equal(0, res.Remaining, algorithm.String())
+			assert.True(res.Reset.After(time.Now().Add(-time.Minute)), algorithm.String())
+			res, err = limiter.Get(ctx, id)
+			assert.Nil(err, algorithm.String())
+			assert.False(res.Allowed, algorithm.String())
+			assert.True(res.RetryAfter > 0 && res.RetryAfter <= time.Second, algorithm.String())
+			res, err = limiter.Peek(ctx, id)
+			assert.Nil(err, algorithm.String())
+			assert.Equal(0, res.Remaining, algorithm.String())
+		}
+	})
+	t.Run("limiter.Wait", func(t *testing.T) {
+		assert := assert.New(t)
+
+		var id = genID()
+		limiter := ratelimiter.New(ratelimiter.Options{Client: &redisClient{client}})
+		policy := []int{1, 100}
+
+		res, err := limiter.Get(ctx, id, policy...)
+		assert.Nil(err)
+		assert.Equal(0, res.Remaining)
+		err = limiter.Wait(ctx, id, policy...)
+		assert.Nil(err)
+		assert.True(time.Now().After(res.Reset))
+
+		timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		err = limiter.Wait(timeout, id, policy...)
+		assert.True(errors.Is(err, ratelimiter.ErrWaitExceedsDeadline))
+	})
+	t.Run("limiter.Reserve", func(t *testing.T) {
+		algorithms := []ratelimiter.Algorithm{
+			ratelimiter.FixedWindow,
+			ratelimiter.TokenBucket,
+			ratelimiter.GCRA,
+			ratelimiter.SlidingLog,
+			ratelimiter.SlidingWindow,
+			ratelimiter.LeakyBucket,
+		}
+		for _, algorithm := range algorithms {
+			assert := assert.New(t)
+
+			var id = genID()
+			limiter := ratelimiter.New(ratelimiter.Options{
+				Client:    &redisClient{client},
+				Algorithm: algorithm,
+			})
+			policy := []int{3, 3600000}
+
+			r, err := limiter.ReserveN(ctx, id, 2, policy...)
+			assert.Nil(err)
+			assert.True(r.OK())
+			assert.Equal(1, r.Remaining)
+
+			refunded, err := r.Cancel(ctx)
+			assert.Nil(err)
+			assert.True(refunded)
+			res, err := limiter.Peek(ctx, id, policy...)
+			assert.Equal(3, res.Remaining)
+
+			refunded, err = r.Cancel(ctx)
+			assert.Nil(err)
+			assert.False(refunded)
+		}
+	})
 	t.Run("ratelimiter with no redis machine should be", func(t *testing.T) {
 		assert := assert.New(t)
 		var client = redis.NewClient(&redis.Options{
@@ -800,7 +1221,8 @@ func TestRedisRatelimiter(t *testing.T) {
 		policy := []int{2, 100, 2, 200, 1, 300}
 		id := genID()
 		res, err := limiter.Get(ctx, id, policy...)
-		assert.Equal("NOSCRIPT mock error", err.Error())
+		assert.Equal("ratelimiter: evalsha: NOSCRIPT mock error", err.Error())
+		assert.True(errors.Is(err, ratelimiter.ErrBackendUnavailable))
 
 		assert.Equal(0, res.Total)
 		assert.Equal(0, res.Remaining)
@@ -809,29 +1231,499 @@ func TestRedisRatelimiter(t *testing.T) {
 	})
 }
 
-func genID() string {
-	buf := make([]byte, 12)
-	_, err := rand.Read(buf)
-	if err != nil {
-		panic(err)
+// Implements RedisClient that fails or returns a fixed result without redis
+type stubClient struct {
+	res   interface{}
+	err   error
+	calls int
+	delay time.Duration
+	args  []interface{} // The arguments of the last call
+}
+
+func (c *stubClient) RateDel(ctx context.Context, key string) error {
+	return c.err
+}
+
+func (c *stubClient) RateEvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) (interface{}, error) {
+	c.calls++
+	c.args = args
+	if c.delay > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(c.delay):
+		}
 	}
-	return hex.EncodeToString(buf)
+	return c.res, c.err
 }
 
-type Result struct {
-	i   int
-	len int
-	s   []int
-	m   sync.Mutex
+func (c *stubClient) RateScriptLoad(ctx context.Context, script string) (string, error) {
+	return "sha1", nil
 }
 
-func NewResult(s []int) Result {
-	return Result{s: s, len: len(s)}
+// flakyClient fails every call with err when it's set, or passes the call to the wrapped client.
+type flakyClient struct {
+	ratelimiter.RedisClient
+	err error
 }
 
-func (r *Result) Push(val int) {
-	r.m.Lock()
-	if r.i == r.len {
+func (c *flakyClient) RateEvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) (interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.RedisClient.RateEvalSha(ctx, sha1, keys, args...)
+}
+
+func TestRedisErrors(t *testing.T) {
+	ctx := context.Background()
+	t.Run("limiter with backend failure should be BackendError", func(t *testing.T) {
+		assert := assert.New(t)
+		cause := errors.New("dial tcp: connection refused")
+		limiter := ratelimiter.New(ratelimiter.Options{Client: &stubClient{err: cause}})
+
+		_, err := limiter.Get(ctx, genID())
+		assert.True(errors.Is(err, ratelimiter.ErrBackendUnavailable))
+		assert.True(errors.Is(err, cause))
+		assert.False(errors.Is(err, ratelimiter.ErrInvalidPolicy))
+		var backendErr *ratelimiter.BackendError
+		assert.True(errors.As(err, &backendErr))
+		assert.Equal("evalsha", backendErr.Op)
+		assert.Equal("ratelimiter: evalsha: dial tcp: connection refused", err.Error())
+
+		err = limiter.Remove(ctx, genID())
+		assert.True(errors.As(err, &backendErr))
+		assert.Equal("del", backendErr.Op)
+	})
+
+	t.Run("limiter with invalid response should be ErrInvalidResponse", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := ratelimiter.New(ratelimiter.Options{Client: &stubClient{res: "OK"}})
+
+		_, err := limiter.Get(ctx, genID())
+		assert.Equal(ratelimiter.ErrInvalidResponse, err)
+		_, err = limiter.Peek(ctx, genID())
+		assert.Equal(ratelimiter.ErrInvalidResponse, err)
+	})
+
+	t.Run("limiter with invalid policy should be ErrInvalidPolicy", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := ratelimiter.New(ratelimiter.Options{Client: &stubClient{res: "OK"}})
+
+		_, err := limiter.Get(ctx, genID(), 10)
+		assert.True(errors.Is(err, ratelimiter.ErrInvalidPolicy))
+		assert.Equal("ratelimiter: must be paired values", err.Error())
+		_, err = limiter.GetN(ctx, genID(), 0)
+		assert.True(errors.Is(err, ratelimiter.ErrInvalidPolicy))
+		_, err = ratelimiter.ParsePolicy("100/1x")
+		assert.True(errors.Is(err, ratelimiter.ErrInvalidPolicy))
+		assert.False(errors.Is(err, ratelimiter.ErrBackendUnavailable))
+	})
+}
+
+func TestFailureMode(t *testing.T) {
+	ctx := context.Background()
+	cause := errors.New("dial tcp: connection refused")
+	t.Run("FailOpen should permit the request", func(t *testing.T) {
+		assert := assert.New(t)
+		var failures []string
+		limiter := ratelimiter.New(ratelimiter.Options{
+			Client:      &stubClient{err: cause},
+			FailureMode: ratelimiter.FailOpen,
+			OnFailure: func(ctx context.Context, key string, err error) {
+				assert.True(errors.Is(err, cause))
+				failures = append(failures, key)
+			},
+		})
+		id := genID()
+
+		res, err := limiter.GetN(ctx, id, 3, 10, 1000)
+		assert.Nil(err)
+		assert.True(res.Allowed)
+		assert.True(res.Degraded)
+		assert.Equal(10, res.Total)
+		assert.Equal(7, res.Remaining)
+		assert.Equal(time.Second, res.Duration)
+		assert.Equal("LIMIT:"+id, res.Key)
+
+		res, err = limiter.Peek(ctx, id)
+		assert.Nil(err)
+		assert.True(res.Allowed)
+		assert.Equal(100, res.Total)
+		assert.Equal(100, res.Remaining)
+		assert.Equal([]string{"LIMIT:" + id, "LIMIT:" + id}, failures)
+
+		// invalid policy is not a backend error
+		_, err = limiter.Get(ctx, id, 10)
+		assert.True(errors.Is(err, ratelimiter.ErrInvalidPolicy))
+		assert.Equal(2, len(failures))
+	})
+
+	t.Run("FailClosed should refuse the request", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := ratelimiter.New(ratelimiter.Options{
+			Client:      &stubClient{err: cause},
+			FailureMode: ratelimiter.FailClosed,
+		})
+
+		res, err := limiter.Get(ctx, genID(), 10, 1000)
+		assert.Nil(err)
+		assert.False(res.Allowed)
+		assert.True(res.Degraded)
+		assert.Equal(-1, res.Remaining)
+		assert.Equal(time.Second, res.RetryAfter)
+		assert.True(res.Reset.After(time.Now()))
+
+		timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		err = limiter.Wait(timeout, genID(), 10, 1000)
+		assert.True(errors.Is(err, ratelimiter.ErrWaitExceedsDeadline))
+	})
+
+	t.Run("FailFallback should get the result from Fallback", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := ratelimiter.New(ratelimiter.Options{
+			Client:      &stubClient{err: cause},
+			FailureMode: ratelimiter.FailFallback,
+			Fallback:    ratelimiter.New(ratelimiter.Options{Max: 2}),
+		})
+		id := genID()
+
+		res, err := limiter.Get(ctx, id)
+		assert.Nil(err)
+		assert.True(res.Degraded)
+		assert.Equal(2, res.Total)
+		assert.Equal(1, res.Remaining)
+		limiter.Get(ctx, id)
+		res, err = limiter.Get(ctx, id)
+		assert.Nil(err)
+		assert.False(res.Allowed)
+	})
+
+	t.Run("FailFallback without Fallback should use divided memory limits", func(t *testing.T) {
+		assert := assert.New(t)
+		client := &stubClient{err: cause}
+		var failures int
+		limiter := ratelimiter.New(ratelimiter.Options{
+			Client:            client,
+			Max:               10,
+			FailureMode:       ratelimiter.FailFallback,
+			FallbackInstances: 3,
+			ProbeInterval:     50 * time.Millisecond,
+			OnFailure: func(ctx context.Context, key string, err error) {
+				failures++
+			},
+		})
+		id := genID()
+
+		res, err := limiter.Get(ctx, id)
+		assert.Nil(err)
+		assert.True(res.Degraded)
+		assert.Equal(4, res.Total)
+		assert.Equal(3, res.Remaining)
+		res, err = limiter.Get(ctx, genID(), 7, 60000, 3, 60000)
+		assert.Nil(err)
+		assert.Equal(3, res.Total)
+
+		// redis is skipped until the probe
+		assert.Equal(1, client.calls)
+		assert.Equal(1, failures)
+		res, err = limiter.Peek(ctx, id)
+		assert.True(res.Degraded)
+		assert.Equal(1, client.calls)
+
+		time.Sleep(50 * time.Millisecond)
+		res, err = limiter.Get(ctx, id)
+		assert.True(res.Degraded)
+		assert.Equal(2, client.calls)
+		assert.Equal(2, failures)
+
+		time.Sleep(50 * time.Millisecond)
+		client.err = nil
+		client.res = []interface{}{int64(9), int64(10), int64(60000), int64(1600000000000)}
+		res, err = limiter.Get(ctx, id)
+		assert.Nil(err)
+		assert.False(res.Degraded)
+		assert.Equal(10, res.Total)
+		res, err = limiter.Get(ctx, id)
+		assert.False(res.Degraded)
+		assert.Equal(4, client.calls)
+	})
+
+	t.Run("FailFallback with Cancel should refund the fallback", func(t *testing.T) {
+		assert := assert.New(t)
+		client := &flakyClient{RedisClient: ratelimitertest.NewRedisClient(nil), err: cause}
+		limiter := ratelimiter.New(ratelimiter.Options{
+			Client:        client,
+			Max:           2,
+			FailureMode:   ratelimiter.FailFallback,
+			ProbeInterval: time.Minute,
+		})
+		id := genID()
+
+		r, err := limiter.Reserve(ctx, id)
+		assert.Nil(err)
+		assert.True(r.Degraded)
+		assert.Equal(1, r.Remaining)
+		refunded, err := r.Cancel(ctx)
+		assert.Nil(err)
+		assert.True(refunded)
+		r, err = limiter.Reserve(ctx, id)
+		assert.Nil(err)
+		assert.True(r.Degraded)
+		assert.Equal(1, r.Remaining)
+	})
+
+	t.Run("FailOpen with Cancel should refund nothing", func(t *testing.T) {
+		assert := assert.New(t)
+		memory, err := ratelimiter.NewMemoryStore(ratelimiter.Options{Algorithm: ratelimiter.TokenBucket})
+		assert.Nil(err)
+		store := &countingStore{Store: memory}
+		limiter := ratelimiter.New(ratelimiter.Options{
+			Store:       store,
+			Max:         2,
+			FailureMode: ratelimiter.FailOpen,
+		})
+		id := genID()
+
+		res, err := limiter.Get(ctx, id)
+		assert.Nil(err)
+		assert.Equal(1, res.Remaining)
+		store.err = cause
+		r, err := limiter.Reserve(ctx, id)
+		assert.Nil(err)
+		assert.True(r.OK())
+		assert.True(r.Degraded)
+		store.err = nil
+		refunded, err := r.Cancel(ctx)
+		assert.Nil(err)
+		assert.False(refunded)
+		res, err = limiter.Peek(ctx, id)
+		assert.Nil(err)
+		assert.Equal(1, res.Remaining)
+	})
+
+	t.Run("FailError should return the error", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := ratelimiter.New(ratelimiter.Options{Client: &stubClient{err: cause}})
+
+		_, err := limiter.Get(ctx, genID())
+		assert.True(errors.Is(err, cause))
+
+		_, err = ratelimiter.NewWithError(ratelimiter.Options{FallbackInstances: -1})
+		assert.True(errors.Is(err, ratelimiter.ErrInvalidOptions))
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	ok := []interface{}{int64(9), int64(10), int64(60000), int64(1600000000000)}
+	t.Run("breaker should open, half-open and close", func(t *testing.T) {
+		assert := assert.New(t)
+		client := &stubClient{err: errors.New("i/o timeout")}
+		var changes []string
+		limiter := ratelimiter.New(ratelimiter.Options{
+			Client:           client,
+			BreakerThreshold: 2,
+			BreakerSuccesses: 2,
+			ProbeInterval:    50 * time.Millisecond,
+			OnBreakerChange: func(from, to ratelimiter.BreakerState) {
+				changes = append(changes, from.String()+">"+to.String())
+			},
+		})
+		assert.Equal(ratelimiter.BreakerClosed, limiter.BreakerState())
+
+		limiter.Get(ctx, genID())
+		assert.Equal(ratelimiter.BreakerClosed, limiter.BreakerState())
+		limiter.Get(ctx, genID())
+		assert.Equal(ratelimiter.BreakerOpen, limiter.BreakerState())
+
+		_, err := limiter.Get(ctx, genID())
+		assert.True(errors.Is(err, ratelimiter.ErrCircuitOpen))
+		assert.True(errors.Is(err, ratelimiter.ErrBackendUnavailable))
+		assert.Equal(2, client.calls)
+
+		// a failed probe opens it again
+		time.Sleep(50 * time.Millisecond)
+		limiter.Get(ctx, genID())
+		assert.Equal(3, client.calls)
+		assert.Equal(ratelimiter.BreakerOpen, limiter.BreakerState())
+
+		time.Sleep(50 * time.Millisecond)
+		client.err = nil
+		client.res = ok
+		_, err = limiter.Get(ctx, genID())
+		assert.Nil(err)
+		assert.Equal(ratelimiter.BreakerHalfOpen, limiter.BreakerState())
+		_, err = limiter.Get(ctx, genID())
+		assert.Nil(err)
+		assert.Equal(ratelimiter.BreakerClosed, limiter.BreakerState())
+		assert.Equal([]string{
+			"BreakerClosed>BreakerOpen",
+			"BreakerOpen>BreakerHalfOpen",
+			"BreakerHalfOpen>BreakerOpen",
+			"BreakerOpen>BreakerHalfOpen",
+			"BreakerHalfOpen>BreakerClosed",
+		}, changes)
+	})
+
+	t.Run("breaker should be disabled by default", func(t *testing.T) {
+		assert := assert.New(t)
+		client := &stubClient{err: errors.New("i/o timeout")}
+		limiter := ratelimiter.New(ratelimiter.Options{Client: client})
+
+		for i := 0; i < 10; i++ {
+			limiter.Get(ctx, genID())
+		}
+		assert.Equal(10, client.calls)
+		assert.Equal(ratelimiter.BreakerClosed, limiter.BreakerState())
+		assert.Equal(ratelimiter.BreakerClosed, ratelimiter.New(ratelimiter.Options{}).BreakerState())
+	})
+
+	t.Run("Timeout should cancel slow redis calls", func(t *testing.T) {
+		assert := assert.New(t)
+		client := &stubClient{res: ok, delay: time.Second}
+		limiter := ratelimiter.New(ratelimiter.Options{
+			Client:           client,
+			Timeout:          20 * time.Millisecond,
+			BreakerThreshold: 1,
+		})
+
+		start := time.Now()
+		_, err := limiter.Get(ctx, genID())
+		assert.True(time.Since(start) < 500*time.Millisecond)
+		assert.True(errors.Is(err, context.DeadlineExceeded))
+		assert.Equal(ratelimiter.BreakerOpen, limiter.BreakerState())
+	})
+
+	t.Run("canceled calls should not open the breaker", func(t *testing.T) {
+		assert := assert.New(t)
+		client := &stubClient{res: ok, delay: time.Second}
+		limiter := ratelimiter.New(ratelimiter.Options{Client: client, BreakerThreshold: 1})
+
+		timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		_, err := limiter.Get(timeout, genID())
+		assert.True(errors.Is(err, context.DeadlineExceeded))
+		assert.Equal(ratelimiter.BreakerClosed, limiter.BreakerState())
+	})
+}
+
+// Implements RedisClient that returns NOSCRIPT until the script is loaded without redis
+type noScriptClient struct {
+	stubClient
+	loaded  map[string]bool
+	loadErr error
+	scripts []string
+}
+
+func (c *noScriptClient) RateEvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) (interface{}, error) {
+	if !c.loaded[sha1] {
+		return nil, errors.New("NOSCRIPT No matching script. Please use EVAL.")
+	}
+	return c.res, c.err
+}
+
+func (c *noScriptClient) RateScriptLoad(ctx context.Context, script string) (string, error) {
+	if c.loadErr != nil {
+		return "", c.loadErr
+	}
+	sum := sha1.Sum([]byte(script))
+	digest := hex.EncodeToString(sum[:])
+	c.loaded[digest] = true
+	c.scripts = append(c.scripts, script)
+	return digest, nil
+}
+
+func TestNewWithError(t *testing.T) {
+	ctx := context.Background()
+	t.Run("NewWithError with invalid Options", func(t *testing.T) {
+		assert := assert.New(t)
+
+		for _, opts := range []ratelimiter.Options{
+			{Max: -1},
+			{Duration: -time.Second},
+			{Duration: time.Microsecond},
+			{Algorithm: ratelimiter.Algorithm(100)},
+		} {
+			limiter, err := ratelimiter.NewWithError(opts)
+			assert.Nil(limiter)
+			assert.True(errors.Is(err, ratelimiter.ErrInvalidOptions), err)
+		}
+		assert.Panics(func() {
+			ratelimiter.New(ratelimiter.Options{Algorithm: ratelimiter.Algorithm(100)})
+		})
+	})
+
+	t.Run("New with invalid Max or Duration should use defaults", func(t *testing.T) {
+		assert := assert.New(t)
+
+		res, err := ratelimiter.New(ratelimiter.Options{Max: -1, Duration: -time.Second}).Get(ctx, genID())
+		assert.Nil(err)
+		assert.Equal(100, res.Total)
+		assert.Equal(time.Minute, res.Duration)
+
+		res, err = ratelimiter.New(ratelimiter.Options{Duration: 500 * time.Microsecond}).Get(ctx, genID())
+		assert.Nil(err)
+		assert.Equal(time.Millisecond, res.Duration)
+	})
+
+	t.Run("NewWithError with script load failure", func(t *testing.T) {
+		assert := assert.New(t)
+		client := &noScriptClient{loaded: map[string]bool{}, loadErr: errors.New("i/o timeout")}
+
+		limiter, err := ratelimiter.NewWithError(ratelimiter.Options{Client: client})
+		assert.Nil(limiter)
+		assert.True(errors.Is(err, ratelimiter.ErrBackendUnavailable))
+		assert.Equal("ratelimiter: script load: i/o timeout", err.Error())
+	})
+
+	t.Run("NewWithError with LazyLoad should load scripts on the first call", func(t *testing.T) {
+		assert := assert.New(t)
+		client := &noScriptClient{loaded: map[string]bool{}, loadErr: errors.New("i/o timeout")}
+
+		limiter, err := ratelimiter.NewWithError(ratelimiter.Options{Client: client, LazyLoad: true})
+		assert.Nil(err)
+		assert.Equal(0, len(client.loaded))
+
+		_, err = limiter.Get(ctx, genID())
+		assert.True(errors.Is(err, ratelimiter.ErrBackendUnavailable))
+
+		client.loadErr = nil
+		client.res = []interface{}{int64(99), int64(100), int64(60000), int64(1600000000000)}
+		res, err := limiter.Get(ctx, genID())
+		assert.Nil(err)
+		assert.Equal(99, res.Remaining)
+		assert.Equal(1, len(client.loaded))
+
+		res, err = limiter.Peek(ctx, genID())
+		assert.Nil(err)
+		assert.Equal(2, len(client.loaded))
+	})
+}
+
+func genID() string {
+	buf := make([]byte, 12)
+	_, err := rand.Read(buf)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+type Result struct {
+	i   int
+	len int
+	s   []int
+	m   sync.Mutex
+}
+
+func NewResult(s []int) Result {
+	return Result{s: s, len: len(s)}
+}
+
+func (r *Result) Push(val int) {
+	r.m.Lock()
+	if r.i == r.len {
 		panic(errors.New("Result overflow"))
 	}
 	r.s[r.i] = val
@@ -842,3 +1734,411 @@ func (r *Result) Push(val int) {
 func (r *Result) Value() []int {
 	return r.s
 }
+
+func TestClock(t *testing.T) {
+	ctx := context.Background()
+	start := time.Unix(1600000000, 0)
+	t.Run("limiter.Get with a manual clock should be", func(t *testing.T) {
+		assert := assert.New(t)
+		clock := ratelimitertest.NewManualClock(start)
+		limiter := ratelimiter.New(ratelimiter.Options{Max: 2, Duration: time.Minute, Clock: clock})
+		defer limiter.Close()
+		id := genID()
+
+		res, _ := limiter.Get(ctx, id)
+		assert.Equal(1, res.Remaining)
+		assert.Equal(start.Add(time.Minute), res.Reset)
+		limiter.Get(ctx, id)
+		res, _ = limiter.Get(ctx, id)
+		assert.Equal(-1, res.Remaining)
+		assert.Equal(time.Minute, res.RetryAfter)
+
+		clock.Advance(59 * time.Second)
+		res, _ = limiter.Get(ctx, id)
+		assert.Equal(-1, res.Remaining)
+		assert.Equal(time.Second, res.RetryAfter)
+
+		clock.Advance(time.Second)
+		res, _ = limiter.Get(ctx, id)
+		assert.Equal(1, res.Remaining)
+		assert.Equal(start.Add(2*time.Minute), res.Reset)
+	})
+
+	t.Run("leaky bucket Wait past the deadline should refund the slot", func(t *testing.T) {
+		assert := assert.New(t)
+		clock := ratelimitertest.NewManualClock(time.Now())
+		limiter := ratelimiter.New(ratelimiter.Options{Max: 2, Duration: 10 * time.Second,
+			Algorithm: ratelimiter.LeakyBucket, Clock: clock})
+		defer limiter.Close()
+		id := genID()
+
+		assert.Nil(limiter.Wait(ctx, id))
+		timeout, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		for i := 0; i < 3; i++ {
+			err := limiter.Wait(timeout, id)
+			assert.True(errors.Is(err, ratelimiter.ErrWaitExceedsDeadline))
+		}
+		res, err := limiter.Peek(ctx, id)
+		assert.Nil(err)
+		assert.Equal(1, res.Remaining)
+		assert.Equal(0, clock.Timers())
+	})
+
+	t.Run("leaky bucket Wait with canceled context should refund the slot", func(t *testing.T) {
+		assert := assert.New(t)
+		clock := ratelimitertest.NewManualClock(time.Now())
+		limiter := ratelimiter.New(ratelimiter.Options{Max: 2, Duration: 10 * time.Second,
+			Algorithm: ratelimiter.LeakyBucket, Clock: clock})
+		defer limiter.Close()
+		id := genID()
+
+		assert.Nil(limiter.Wait(ctx, id))
+		canceled, cancel := context.WithCancel(ctx)
+		done := make(chan error)
+		go func() {
+			done <- limiter.Wait(canceled, id)
+		}()
+		for clock.Timers() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+		assert.Equal(context.Canceled, <-done)
+		res, err := limiter.Peek(ctx, id)
+		assert.Nil(err)
+		assert.Equal(1, res.Remaining)
+	})
+
+	t.Run("token bucket with a manual clock should be", func(t *testing.T) {
+		assert := assert.New(t)
+		clock := ratelimitertest.NewManualClock(start)
+		limiter := ratelimiter.New(ratelimiter.Options{
+			Max:       10,
+			Duration:  10 * time.Second,
+			Algorithm: ratelimiter.TokenBucket,
+			Clock:     clock,
+		})
+		defer limiter.Close()
+		id := genID()
+
+		res, _ := limiter.GetN(ctx, id, 10)
+		assert.Equal(0, res.Remaining)
+		assert.Equal(start.Add(10*time.Second), res.Reset)
+
+		clock.Advance(3 * time.Second)
+		res, _ = limiter.Peek(ctx, id)
+		assert.Equal(3, res.Remaining)
+		res, _ = limiter.GetN(ctx, id, 4)
+		assert.Equal(-1, res.Remaining)
+		assert.Equal(time.Second, res.RetryAfter)
+	})
+
+	t.Run("limiter.Wait with a manual clock should be", func(t *testing.T) {
+		assert := assert.New(t)
+		clock := ratelimitertest.NewManualClock(start)
+		limiter := ratelimiter.New(ratelimiter.Options{Max: 1, Duration: time.Hour, Clock: clock})
+		defer limiter.Close()
+		id := genID()
+
+		limiter.Get(ctx, id)
+		done := make(chan error)
+		go func() {
+			done <- limiter.Wait(ctx, id)
+		}()
+		for clock.Timers() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		select {
+		case <-done:
+			t.Fatal("Wait should block until the clock is advanced")
+		default:
+		}
+		clock.Advance(time.Hour)
+		assert.Nil(<-done)
+		assert.Equal(0, clock.Timers())
+	})
+
+	t.Run("redis limiter with a manual clock should be", func(t *testing.T) {
+		assert := assert.New(t)
+		clock := ratelimitertest.NewManualClock(start)
+		client := &stubClient{res: []interface{}{int64(9), int64(10), int64(60000), int64(1600000060000)}}
+		limiter := ratelimiter.New(ratelimiter.Options{Client: client, Clock: clock})
+
+		limiter.Get(ctx, genID())
+		assert.Equal("1600000000000", client.args[0])
+		clock.Advance(time.Second)
+		limiter.Get(ctx, genID())
+		assert.Equal("1600000001000", client.args[0])
+	})
+
+	t.Run("redis limiter with ServerTime should be", func(t *testing.T) {
+		assert := assert.New(t)
+		clock := ratelimitertest.NewManualClock(start)
+		server := start.Add(time.Hour).UnixNano() / 1e6
+		client := &noScriptClient{loaded: map[string]bool{}}
+		client.res = []interface{}{int64(-1), int64(10), int64(60000), server + 30000, int64(0), int64(1), server}
+		limiter := ratelimiter.New(ratelimiter.Options{Client: client, Clock: clock, ServerTime: true})
+
+		assert.Equal(3, len(client.scripts))
+		for _, script := range client.scripts {
+			assert.Contains(script, "redis.call('TIME')")
+		}
+		res, err := limiter.Get(ctx, genID())
+		assert.Nil(err)
+		assert.Equal(time.Unix(0, (server+30000)*1e6), res.Reset)
+		assert.Equal(30*time.Second, res.RetryAfter)
+		assert.Equal(0, res.Tier)
+	})
+
+	t.Run("limiter.Reserve with ServerTime should refund at the server time", func(t *testing.T) {
+		assert := assert.New(t)
+		clock := ratelimitertest.NewManualClock(start)
+		server := start.Add(time.Hour).UnixNano() / 1e6
+		client := &stubClient{}
+		client.res = []interface{}{int64(9), int64(10), int64(60000), server + 30000, int64(0), int64(1), server}
+		limiter := ratelimiter.New(ratelimiter.Options{Client: client, Clock: clock, ServerTime: true})
+
+		r, err := limiter.Reserve(ctx, genID())
+		assert.Nil(err)
+		assert.True(r.OK())
+		client.res = int64(1)
+		refunded, err := r.Cancel(ctx)
+		assert.Nil(err)
+		assert.True(refunded)
+		assert.Equal(strconv.FormatInt(server, 10), client.args[3])
+	})
+
+	t.Run("circuit breaker with a manual clock should be", func(t *testing.T) {
+		assert := assert.New(t)
+		clock := ratelimitertest.NewManualClock(start)
+		client := &stubClient{err: errors.New("i/o timeout")}
+		limiter := ratelimiter.New(ratelimiter.Options{
+			Client:           client,
+			BreakerThreshold: 1,
+			ProbeInterval:    time.Minute,
+			Clock:            clock,
+		})
+
+		limiter.Get(ctx, genID())
+		assert.Equal(ratelimiter.BreakerOpen, limiter.BreakerState())
+		clock.Advance(time.Minute - time.Millisecond)
+		limiter.Get(ctx, genID())
+		assert.Equal(1, client.calls)
+
+		client.err = nil
+		client.res = []interface{}{int64(9), int64(10), int64(60000), int64(1600000060000)}
+		clock.Advance(time.Millisecond)
+		_, err := limiter.Get(ctx, genID())
+		assert.Nil(err)
+		assert.Equal(2, client.calls)
+		assert.Equal(ratelimiter.BreakerClosed, limiter.BreakerState())
+	})
+}
+
+// countingStore counts the Take calls of a Store, and fails them with err when it's set.
+type countingStore struct {
+	ratelimiter.Store
+	takes  int
+	closed bool
+	err    error
+}
+
+func (s *countingStore) Take(ctx context.Context, key string, cost int, policy ratelimiter.Policy) (ratelimiter.Result, error) {
+	s.takes++
+	if s.err != nil {
+		return ratelimiter.Result{}, s.err
+	}
+	return s.Store.Take(ctx, key, cost, policy)
+}
+
+func (s *countingStore) Close() error {
+	s.closed = true
+	return s.Store.Close()
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	for _, algorithm := range []ratelimiter.Algorithm{ratelimiter.FixedWindow, ratelimiter.TokenBucket,
+		ratelimiter.GCRA, ratelimiter.SlidingLog, ratelimiter.SlidingWindow, ratelimiter.LeakyBucket} {
+		algorithm := algorithm
+		t.Run("memory store with "+algorithm.String(), func(t *testing.T) {
+			ratelimitertest.TestStore(t, func() ratelimiter.Store {
+				store, err := ratelimiter.NewMemoryStore(ratelimiter.Options{Algorithm: algorithm})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return store
+			})
+		})
+	}
+
+	t.Run("limiter with a custom Store should be", func(t *testing.T) {
+		assert := assert.New(t)
+		memory, err := ratelimiter.NewMemoryStore(ratelimiter.Options{})
+		assert.Nil(err)
+		store := &countingStore{Store: memory}
+		limiter := ratelimiter.New(ratelimiter.Options{Store: store, Max: 3})
+		id := genID()
+
+		res, err := limiter.Get(ctx, id)
+		assert.Nil(err)
+		assert.Equal(2, res.Remaining)
+		assert.Equal(3, res.Total)
+		assert.Equal("LIMIT:"+id, res.Key)
+		res, err = limiter.Peek(ctx, id)
+		assert.Equal(2, res.Remaining)
+		assert.Equal(1, store.takes)
+
+		assert.Nil(limiter.Close())
+		assert.True(store.closed)
+	})
+
+	t.Run("NewRedisStore and NewMemoryStore with invalid Options", func(t *testing.T) {
+		assert := assert.New(t)
+		_, err := ratelimiter.NewRedisStore(ratelimiter.Options{})
+		assert.True(errors.Is(err, ratelimiter.ErrInvalidOptions))
+		_, err = ratelimiter.NewMemoryStore(ratelimiter.Options{Max: -1})
+		assert.True(errors.Is(err, ratelimiter.ErrInvalidOptions))
+		_, err = ratelimiter.NewWithError(ratelimiter.Options{Client: &stubClient{}, Store: &countingStore{}})
+		assert.True(errors.Is(err, ratelimiter.ErrInvalidOptions))
+	})
+}
+
+func TestConformance(t *testing.T) {
+	t.Run("memory limiter", func(t *testing.T) {
+		ratelimitertest.TestLimiter(t, func(opts ratelimiter.Options) *ratelimiter.Limiter {
+			return ratelimiter.New(opts)
+		})
+	})
+
+	t.Run("memory store with a single shard", func(t *testing.T) {
+		ratelimitertest.TestLimiter(t, func(opts ratelimiter.Options) *ratelimiter.Limiter {
+			opts.Shards = 1
+			store, err := ratelimiter.NewMemoryStore(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts.Store = store
+			return ratelimiter.New(opts)
+		})
+	})
+
+	t.Run("memory limiter in real time", func(t *testing.T) {
+		ratelimitertest.TestLimiterRealTime(t, func(opts ratelimiter.Options) *ratelimiter.Limiter {
+			return ratelimiter.New(opts)
+		}, ratelimiter.TokenBucket, ratelimiter.GCRA, ratelimiter.LeakyBucket)
+	})
+}
+
+func TestInProcessRedis(t *testing.T) {
+	ctx := context.Background()
+	t.Run("redis limiter conformance", func(t *testing.T) {
+		ratelimitertest.TestLimiter(t, func(opts ratelimiter.Options) *ratelimiter.Limiter {
+			opts.Client = ratelimitertest.NewRedisClient(opts.Clock)
+			return ratelimiter.New(opts)
+		}, ratelimiter.FixedWindow)
+	})
+
+	t.Run("redis limiter with ServerTime conformance", func(t *testing.T) {
+		ratelimitertest.TestLimiter(t, func(opts ratelimiter.Options) *ratelimiter.Limiter {
+			opts.Client = ratelimitertest.NewRedisClient(opts.Clock)
+			opts.ServerTime = true
+			return ratelimiter.New(opts)
+		}, ratelimiter.FixedWindow)
+	})
+
+	t.Run("redis store conformance", func(t *testing.T) {
+		ratelimitertest.TestStore(t, func() ratelimiter.Store {
+			store, err := ratelimiter.NewRedisStore(ratelimiter.Options{Client: ratelimitertest.NewRedisClient(nil)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		})
+	})
+
+	t.Run("RedisClient should return NOSCRIPT until the script is loaded", func(t *testing.T) {
+		assert := assert.New(t)
+		client := ratelimitertest.NewRedisClient(nil)
+		limiter := ratelimiter.New(ratelimiter.Options{Client: client, Max: 2, LazyLoad: true})
+		id := genID()
+
+		_, err := client.RateEvalSha(ctx, "0000000000000000000000000000000000000000", []string{id})
+		assert.NotNil(err)
+		assert.True(strings.HasPrefix(err.Error(), "NOSCRIPT "))
+
+		res, err := limiter.Get(ctx, id)
+		assert.Nil(err)
+		assert.Equal(1, res.Remaining)
+		client.FlushScripts()
+		res, err = limiter.Get(ctx, id)
+		assert.Nil(err)
+		assert.Equal(0, res.Remaining)
+		res, err = limiter.Peek(ctx, id)
+		assert.Nil(err)
+		assert.Equal(0, res.Remaining)
+	})
+
+	t.Run("RedisClient with unsupported scripts should fail", func(t *testing.T) {
+		assert := assert.New(t)
+		for _, algorithm := range []ratelimiter.Algorithm{ratelimiter.TokenBucket, ratelimiter.GCRA,
+			ratelimiter.SlidingLog, ratelimiter.SlidingWindow, ratelimiter.LeakyBucket} {
+			for _, serverTime := range []bool{false, true} {
+				opts := ratelimiter.Options{
+					Client:     ratelimitertest.NewRedisClient(nil),
+					Algorithm:  algorithm,
+					ServerTime: serverTime,
+				}
+				_, err := ratelimiter.NewWithError(opts)
+				assert.True(errors.Is(err, ratelimiter.ErrBackendUnavailable), algorithm.String())
+				assert.Contains(err.Error(), "unsupported script", algorithm.String())
+
+				opts.LazyLoad = true
+				limiter, err := ratelimiter.NewWithError(opts)
+				assert.Nil(err)
+				_, err = limiter.Get(ctx, genID())
+				assert.True(errors.Is(err, ratelimiter.ErrBackendUnavailable), algorithm.String())
+				assert.Contains(err.Error(), "unsupported script", algorithm.String())
+				limiter.Close()
+			}
+		}
+	})
+
+	t.Run("RedisClient should emulate the current scripts", func(t *testing.T) {
+		assert := assert.New(t)
+		// the digests of the scripts RedisClient is written for, update them only after the
+		// emulation in ratelimitertest/redis.go is updated for a changed script
+		emulated := map[string]scripts.Digests{
+			scripts.FixedWindow: {
+				Sha1:           "c8a7e6716f7a7bbc09710dca6fc89613a39b0ea7",
+				ServerTimeSha1: "1ebe170580110cf51059afef6ab432fcff0298d6",
+			},
+			scripts.Peek: {
+				Sha1:           "92f77b1416c1477f85f1b87106e37e5c283baf7d",
+				ServerTimeSha1: "b7a168ab900ce0e9ed387774299e4df3cc461911",
+			},
+			scripts.Refund: {
+				Sha1:           "0200a96193969c531e35274aa377d47db2931dde",
+				ServerTimeSha1: "8d79372f6d3e9d529b32b7f41119aac3bf81d11c",
+			},
+		}
+		for name, digests := range emulated {
+			assert.Equal(digests, scripts.Lookup(name), "the %s script is changed", name)
+		}
+	})
+
+	t.Run("limiter.Reserve with RedisClient should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := ratelimiter.New(ratelimiter.Options{Client: ratelimitertest.NewRedisClient(nil), Max: 2})
+		id := genID()
+
+		r, err := limiter.Reserve(ctx, id)
+		assert.Nil(err)
+		assert.Equal(1, r.Remaining)
+		refunded, err := r.Cancel(ctx)
+		assert.Nil(err)
+		assert.True(refunded)
+		res, _ := limiter.Peek(ctx, id)
+		assert.Equal(2, res.Remaining)
+	})
+}
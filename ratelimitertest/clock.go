@@ -0,0 +1,104 @@
+// Package ratelimitertest provides helpers to test code using ratelimiter without redis or
+// sleeping. Its RedisClient only emulates the FixedWindow scripts, the other algorithms fail
+// with an unsupported script error.
+package ratelimitertest
+
+import (
+	"sync"
+	"time"
+
+	ratelimiter "github.com/ilam01/limits-go"
+)
+
+// ManualClock is a ratelimiter.Clock that only moves when it's advanced, its timers fire as
+// soon as the clock passes their deadlines.
+/*
+ManualClock tests a limiter without sleeping:
+
+    clock := ratelimitertest.NewManualClock(time.Unix(0, 0))
+    limiter := ratelimiter.New(ratelimiter.Options{Max: 1, Clock: clock})
+    limiter.Get(ctx, id) // Remaining: 0
+    clock.Advance(time.Minute)
+    limiter.Get(ctx, id) // Remaining: 0
+*/
+type ManualClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+// NewManualClock returns a ManualClock starting at now.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+// Now returns the current time of the clock.
+func (c *ManualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// NewTimer returns a Timer firing when the clock is advanced by d, or at once if d <= 0.
+func (c *ManualClock) NewTimer(d time.Duration) ratelimiter.Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t := &manualTimer{clock: c, deadline: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, and fires the timers passed.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set moves the clock to now, and fires the timers passed.
+func (c *ManualClock) Set(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = now
+	timers := c.timers[:0]
+	for _, t := range c.timers {
+		if t.deadline.After(now) {
+			timers = append(timers, t)
+		} else {
+			t.c <- now
+		}
+	}
+	c.timers = timers
+}
+
+// Timers returns the count of timers waiting for the clock, e.g. to advance it after a
+// goroutine blocks in Limiter.Wait.
+func (c *ManualClock) Timers() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.timers)
+}
+
+type manualTimer struct {
+	clock    *ManualClock
+	deadline time.Time
+	c        chan time.Time
+}
+
+func (t *manualTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *manualTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,335 @@
+package ratelimitertest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ratelimiter "github.com/ilam01/limits-go"
+)
+
+// start is the time every conformance case starts at, it's aligned to minutes for SlidingWindow.
+var start = time.Unix(1600000020, 0)
+
+// limiterCase is a conformance case, a sequence of calls to a limiter and their Results.
+type limiterCase struct {
+	name      string
+	algorithm ratelimiter.Algorithm
+	max       int
+	duration  time.Duration
+	policy    ratelimiter.Policy
+	steps     []step
+}
+
+// step advances the clock by advance, then calls Get with cost, or Peek, or Remove.
+type step struct {
+	advance time.Duration
+	cost    int // The cost of Get, 1 if it's 0
+	peek    bool
+	remove  bool
+	want    result
+}
+
+// result is the expected Result of a step, Reset is the offset from start.
+type result struct {
+	Remaining  int
+	Total      int
+	Duration   time.Duration
+	Reset      time.Duration
+	Delay      time.Duration
+	RetryAfter time.Duration
+	Tier       int
+}
+
+var limiterCases = []limiterCase{
+	{
+		name:      "FixedWindow",
+		algorithm: ratelimiter.FixedWindow,
+		max:       3,
+		duration:  time.Minute,
+		steps: []step{
+			{want: result{Remaining: 2, Total: 3, Duration: time.Minute, Reset: time.Minute}},
+			{want: result{Remaining: 1, Total: 3, Duration: time.Minute, Reset: time.Minute}},
+			{peek: true, want: result{Remaining: 1, Total: 3, Duration: time.Minute, Reset: time.Minute}},
+			{want: result{Remaining: 0, Total: 3, Duration: time.Minute, Reset: time.Minute}},
+			{want: result{Remaining: -1, Total: 3, Duration: time.Minute, Reset: time.Minute, RetryAfter: time.Minute}},
+			{advance: 20 * time.Second, peek: true,
+				want: result{Remaining: 0, Total: 3, Duration: time.Minute, Reset: time.Minute, RetryAfter: 40 * time.Second}},
+			{advance: 20 * time.Second,
+				want: result{Remaining: -1, Total: 3, Duration: time.Minute, Reset: time.Minute, RetryAfter: 20 * time.Second}},
+			{advance: 21 * time.Second, want: result{Remaining: 2, Total: 3, Duration: time.Minute, Reset: 121 * time.Second}},
+		},
+	},
+	{
+		name:      "FixedWindow with cost",
+		algorithm: ratelimiter.FixedWindow,
+		max:       3,
+		duration:  time.Minute,
+		steps: []step{
+			{cost: 2, want: result{Remaining: 1, Total: 3, Duration: time.Minute, Reset: time.Minute}},
+			{cost: 2, want: result{Remaining: -1, Total: 3, Duration: time.Minute, Reset: time.Minute, RetryAfter: time.Minute}},
+			{cost: 1, want: result{Remaining: 0, Total: 3, Duration: time.Minute, Reset: time.Minute}},
+			{remove: true},
+			{advance: time.Second, peek: true, want: result{Remaining: 3, Total: 3, Duration: time.Minute, Reset: time.Second}},
+			{cost: 3, want: result{Remaining: 0, Total: 3, Duration: time.Minute, Reset: 61 * time.Second}},
+		},
+	},
+	{
+		name:      "FixedWindow with multi-policy",
+		algorithm: ratelimiter.FixedWindow,
+		policy:    ratelimiter.Policy{{Max: 2, Duration: time.Minute}, {Max: 1, Duration: time.Minute}, {Max: 1, Duration: 2 * time.Minute}},
+		steps: []step{
+			{want: result{Remaining: 1, Total: 2, Duration: time.Minute, Reset: time.Minute}},
+			{want: result{Remaining: 0, Total: 2, Duration: time.Minute, Reset: time.Minute}},
+			// the first refusal escalates to the next tier
+			{want: result{Remaining: -1, Total: 2, Duration: time.Minute, Reset: time.Minute, RetryAfter: time.Minute}},
+			{want: result{Remaining: -1, Total: 2, Duration: time.Minute, Reset: time.Minute, RetryAfter: time.Minute}},
+			{advance: 61 * time.Second, peek: true,
+				want: result{Remaining: 1, Total: 1, Duration: time.Minute, Reset: 61 * time.Second, Tier: 1}},
+			{want: result{Remaining: 0, Total: 1, Duration: time.Minute, Reset: 121 * time.Second, Tier: 1}},
+			{want: result{Remaining: -1, Total: 1, Duration: time.Minute, Reset: 121 * time.Second, RetryAfter: time.Minute, Tier: 1}},
+			{advance: 61 * time.Second,
+				want: result{Remaining: 0, Total: 1, Duration: 2 * time.Minute, Reset: 242 * time.Second, Tier: 2}},
+			// the last tier is kept after another refusal
+			{want: result{Remaining: -1, Total: 1, Duration: 2 * time.Minute, Reset: 242 * time.Second, RetryAfter: 2 * time.Minute, Tier: 2}},
+			{advance: 121 * time.Second,
+				want: result{Remaining: 0, Total: 1, Duration: 2 * time.Minute, Reset: 363 * time.Second, Tier: 2}},
+			// the escalation expires after two durations without a refusal
+			{advance: 121 * time.Second, want: result{Remaining: 1, Total: 2, Duration: time.Minute, Reset: 424 * time.Second}},
+		},
+	},
+	{
+		name:      "TokenBucket",
+		algorithm: ratelimiter.TokenBucket,
+		max:       10,
+		duration:  10 * time.Second,
+		steps: []step{
+			{cost: 10, want: result{Remaining: 0, Total: 10, Duration: 10 * time.Second, Reset: 10 * time.Second}},
+			{want: result{Remaining: -1, Total: 10, Duration: 10 * time.Second, Reset: 10 * time.Second, RetryAfter: time.Second}},
+			{advance: 3 * time.Second, peek: true, want: result{Remaining: 3, Total: 10, Duration: 10 * time.Second, Reset: 10 * time.Second}},
+			{cost: 4, want: result{Remaining: -1, Total: 10, Duration: 10 * time.Second, Reset: 10 * time.Second, RetryAfter: time.Second}},
+			{cost: 3, want: result{Remaining: 0, Total: 10, Duration: 10 * time.Second, Reset: 13 * time.Second}},
+			{advance: 20 * time.Second, peek: true, want: result{Remaining: 10, Total: 10, Duration: 10 * time.Second, Reset: 23 * time.Second}},
+		},
+	},
+	{
+		name:      "GCRA",
+		algorithm: ratelimiter.GCRA,
+		max:       10,
+		duration:  10 * time.Second,
+		steps: []step{
+			{cost: 10, want: result{Remaining: 0, Total: 10, Duration: 10 * time.Second, Reset: 10 * time.Second}},
+			{want: result{Remaining: -1, Total: 10, Duration: 10 * time.Second, Reset: 10 * time.Second, RetryAfter: time.Second}},
+			{advance: 3 * time.Second, peek: true, want: result{Remaining: 3, Total: 10, Duration: 10 * time.Second, Reset: 10 * time.Second}},
+			{cost: 4, want: result{Remaining: -1, Total: 10, Duration: 10 * time.Second, Reset: 10 * time.Second, RetryAfter: time.Second}},
+			{cost: 3, want: result{Remaining: 0, Total: 10, Duration: 10 * time.Second, Reset: 13 * time.Second}},
+		},
+	},
+	{
+		name:      "SlidingLog",
+		algorithm: ratelimiter.SlidingLog,
+		max:       3,
+		duration:  time.Minute,
+		steps: []step{
+			{want: result{Remaining: 2, Total: 3, Duration: time.Minute, Reset: time.Minute}},
+			{advance: 20 * time.Second, want: result{Remaining: 1, Total: 3, Duration: time.Minute, Reset: time.Minute}},
+			{advance: 20 * time.Second, want: result{Remaining: 0, Total: 3, Duration: time.Minute, Reset: time.Minute}},
+			{want: result{Remaining: -1, Total: 3, Duration: time.Minute, Reset: time.Minute, RetryAfter: 20 * time.Second}},
+			{advance: 21 * time.Second, peek: true, want: result{Remaining: 1, Total: 3, Duration: time.Minute, Reset: 80 * time.Second}},
+			{want: result{Remaining: 0, Total: 3, Duration: time.Minute, Reset: 80 * time.Second}},
+		},
+	},
+	{
+		name:      "SlidingWindow",
+		algorithm: ratelimiter.SlidingWindow,
+		max:       10,
+		duration:  time.Minute,
+		steps: []step{
+			// one request is freed when the window moves by a tenth
+			{cost: 10, want: result{Remaining: 0, Total: 10, Duration: time.Minute, Reset: 66 * time.Second}},
+			{want: result{Remaining: -1, Total: 10, Duration: time.Minute, Reset: 66 * time.Second, RetryAfter: 66 * time.Second}},
+			// half of the previous window is weighted
+			{advance: 90 * time.Second, peek: true, want: result{Remaining: 5, Total: 10, Duration: time.Minute, Reset: 96 * time.Second}},
+			{cost: 5, want: result{Remaining: 0, Total: 10, Duration: time.Minute, Reset: 96 * time.Second}},
+		},
+	},
+	{
+		name:      "LeakyBucket",
+		algorithm: ratelimiter.LeakyBucket,
+		max:       2,
+		duration:  10 * time.Second,
+		steps: []step{
+			{want: result{Remaining: 1, Total: 2, Duration: 10 * time.Second, Reset: 5 * time.Second}},
+			{want: result{Remaining: 0, Total: 2, Duration: 10 * time.Second, Reset: 10 * time.Second, Delay: 5 * time.Second}},
+			{want: result{Remaining: -1, Total: 2, Duration: 10 * time.Second, Reset: 10 * time.Second, RetryAfter: 5 * time.Second}},
+			{advance: 5 * time.Second, peek: true,
+				want: result{Remaining: 1, Total: 2, Duration: 10 * time.Second, Reset: 10 * time.Second, Delay: 5 * time.Second}},
+			{want: result{Remaining: 0, Total: 2, Duration: 10 * time.Second, Reset: 15 * time.Second, Delay: 5 * time.Second}},
+		},
+	},
+}
+
+// realTimeScale divides the durations of the conformance cases run in real time.
+const realTimeScale = 50
+
+// TestLimiter runs the conformance cases of a Limiter, and checks every Result of them. Every
+// case makes a limiter by newLimiter with the Algorithm, Max, Duration and Clock options set,
+// and closes it. The Clock is a ManualClock, so the backend must read the time from it, e.g.
+// a memory limiter, a RedisClient of this package or a custom Store using it, use
+// TestLimiterRealTime for a backend with its own clock. Only the cases of algorithms are run if
+// any is given.
+/*
+TestLimiter checks the memory limiter:
+
+    func TestMemoryConformance(t *testing.T) {
+        ratelimitertest.TestLimiter(t, func(opts ratelimiter.Options) *ratelimiter.Limiter {
+            return ratelimiter.New(opts)
+        })
+    }
+*/
+func TestLimiter(t *testing.T, newLimiter func(opts ratelimiter.Options) *ratelimiter.Limiter, algorithms ...ratelimiter.Algorithm) {
+	testLimiter(t, newLimiter, false, algorithms)
+}
+
+// TestLimiterRealTime runs the conformance cases of TestLimiter in real time, for a backend that
+// can't read the time from a ManualClock, e.g. a real redis expiring the keys by its own clock.
+// The Clock option is nil, the durations of the cases are divided by 50 and the steps sleep for
+// them, so it takes about 15 seconds to run all the cases. The times of the Results are checked
+// with a tolerance of 20ms.
+/*
+TestLimiterRealTime checks a redis limiter:
+
+    func TestRedisConformance(t *testing.T) {
+        ratelimitertest.TestLimiterRealTime(t, func(opts ratelimiter.Options) *ratelimiter.Limiter {
+            opts.Client = &redisClient{client}
+            return ratelimiter.New(opts)
+        })
+    }
+*/
+func TestLimiterRealTime(t *testing.T, newLimiter func(opts ratelimiter.Options) *ratelimiter.Limiter, algorithms ...ratelimiter.Algorithm) {
+	testLimiter(t, newLimiter, true, algorithms)
+}
+
+func testLimiter(t *testing.T, newLimiter func(opts ratelimiter.Options) *ratelimiter.Limiter, realTime bool, algorithms []ratelimiter.Algorithm) {
+	ctx := context.Background()
+	scale := func(d time.Duration) time.Duration {
+		if realTime {
+			return d / realTimeScale
+		}
+		return d
+	}
+	// the steps of the cases are at least a second apart from the boundaries they test
+	var tolerance time.Duration
+	if realTime {
+		tolerance = scale(time.Second)
+	}
+
+	for _, c := range limiterCases {
+		if !hasAlgorithm(algorithms, c.algorithm) {
+			continue
+		}
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			opts := ratelimiter.Options{
+				Algorithm: c.algorithm,
+				Max:       c.max,
+				Duration:  scale(c.duration),
+			}
+			var policy ratelimiter.Policy
+			for _, tier := range c.policy {
+				policy = append(policy, ratelimiter.Tier{Max: tier.Max, Duration: scale(tier.Duration)})
+			}
+			begin := start
+			var clock *ManualClock
+			if realTime {
+				// the cases start at a time aligned to their duration, as start is
+				begin = time.Now()
+				if opts.Duration > 0 {
+					ns := begin.UnixNano()
+					begin = time.Unix(0, ns-ns%int64(opts.Duration)+int64(opts.Duration))
+				}
+			} else {
+				clock = NewManualClock(start)
+				opts.Clock = clock
+			}
+			limiter := newLimiter(opts)
+			defer limiter.Close()
+			id := genKey()
+
+			var elapsed time.Duration
+			for i, s := range c.steps {
+				elapsed += scale(s.advance)
+				if realTime && i == 0 {
+					// the later steps are timed from the first one, even if it's late
+					time.Sleep(time.Until(begin))
+					begin = time.Now()
+				} else if realTime {
+					time.Sleep(time.Until(begin.Add(elapsed + tolerance/4)))
+				} else {
+					clock.Advance(s.advance)
+				}
+				if s.remove {
+					if err := limiter.Remove(ctx, id); err != nil {
+						t.Fatalf("step %d: Remove error: %v", i, err)
+					}
+					continue
+				}
+
+				var got ratelimiter.Result
+				var err error
+				cost := s.cost
+				if cost == 0 {
+					cost = 1
+				}
+				if s.peek {
+					got, err = limiter.PeekPolicy(ctx, id, policy)
+				} else {
+					got, err = limiter.GetNPolicy(ctx, id, cost, policy)
+				}
+				if err != nil {
+					t.Fatalf("step %d: error: %v", i, err)
+				}
+
+				want := ratelimiter.Result{
+					Total:      s.want.Total,
+					Remaining:  s.want.Remaining,
+					Duration:   scale(s.want.Duration),
+					Reset:      begin.Add(scale(s.want.Reset)),
+					Delay:      scale(s.want.Delay),
+					Allowed:    s.want.Remaining >= 0 && (!s.peek || s.want.Remaining >= cost),
+					RetryAfter: scale(s.want.RetryAfter),
+					Tier:       s.want.Tier,
+					Key:        got.Key,
+				}
+				if !within(got.Reset.Sub(want.Reset), tolerance) {
+					t.Errorf("step %d: Reset = %v, want %v", i, got.Reset.Sub(begin), scale(s.want.Reset))
+				}
+				got.Reset = want.Reset
+				if within(got.Delay-want.Delay, tolerance) {
+					got.Delay = want.Delay
+				}
+				if within(got.RetryAfter-want.RetryAfter, tolerance) {
+					got.RetryAfter = want.RetryAfter
+				}
+				if got != want {
+					t.Errorf("step %d: Result = %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+// within reports whether the difference d is within the tolerance.
+func within(d, tolerance time.Duration) bool {
+	return d >= -tolerance && d <= tolerance
+}
+
+// hasAlgorithm reports whether algorithms has algorithm, or algorithms is empty.
+func hasAlgorithm(algorithms []ratelimiter.Algorithm, algorithm ratelimiter.Algorithm) bool {
+	for _, a := range algorithms {
+		if a == algorithm {
+			return true
+		}
+	}
+	return len(algorithms) == 0
+}
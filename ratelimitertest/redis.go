@@ -0,0 +1,363 @@
+package ratelimitertest
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	ratelimiter "github.com/ilam01/limits-go"
+	"github.com/ilam01/limits-go/internal/scripts"
+)
+
+// RedisClient is an in-process ratelimiter.RedisClient for tests without redis. It runs the
+// FixedWindow scripts of a Limiter in Go, on hashes and strings emulating the hmget, hmset,
+// hset, hincrby, incr, get, pexpire and del commands, and expires keys by its Clock. Scripts
+// are keyed by their SHA1 digests, RateEvalSha returns a NOSCRIPT error until RateScriptLoad
+// loads the script, like redis does. Other scripts can't be loaded: a Limiter of another
+// Algorithm fails with an unsupported script error in NewWithError, or in its first call with
+// Options.LazyLoad, so their Lua scripts are only tested against a real redis.
+/*
+RedisClient exercises the redis path of a Limiter offline:
+
+    clock := ratelimitertest.NewManualClock(time.Now())
+    limiter := ratelimiter.New(ratelimiter.Options{
+        Client: ratelimitertest.NewRedisClient(clock),
+        Clock:  clock,
+    })
+*/
+type RedisClient struct {
+	clock   ratelimiter.Clock
+	lock    sync.Mutex
+	scripts map[string]redisScript
+	hashes  map[string]map[string]string
+	strings map[string]string
+	expires map[string]time.Time
+}
+
+// redisScript is a script emulated in Go.
+type redisScript struct {
+	run        func(c *RedisClient, now int64, keys, argv []string) (interface{}, error)
+	serverTime bool // The script is run with the redis server time, see Options.ServerTime
+}
+
+// NewRedisClient returns an empty RedisClient reading the time from clock, or the system time
+// if clock is nil.
+func NewRedisClient(clock ratelimiter.Clock) *RedisClient {
+	return &RedisClient{
+		clock:   clock,
+		scripts: make(map[string]redisScript),
+		hashes:  make(map[string]map[string]string),
+		strings: make(map[string]string),
+		expires: make(map[string]time.Time),
+	}
+}
+
+// RateDel implements ratelimiter.RedisClient.
+func (c *RedisClient) RateDel(ctx context.Context, key string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.del(key)
+	return nil
+}
+
+// RateEvalSha implements ratelimiter.RedisClient, it runs the loaded script of sha1 atomically.
+func (c *RedisClient) RateEvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) (interface{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	script, ok := c.scripts[sha1]
+	if !ok {
+		return nil, errors.New("NOSCRIPT No matching script. Please use EVAL.")
+	}
+	argv := make([]string, len(args))
+	for i, arg := range args {
+		s, ok := arg.(string)
+		if !ok {
+			return nil, errors.New("ERR ratelimitertest: arguments must be strings")
+		}
+		argv[i] = s
+	}
+	now, err := strconv.ParseInt(argv[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("ERR ratelimitertest: invalid timestamp")
+	}
+	if script.serverTime {
+		now = c.now().UnixNano() / 1e6
+	}
+	res, err := script.run(c, now, keys, argv)
+	if arr, ok := res.([]interface{}); ok && script.serverTime {
+		res = append(arr, now)
+	}
+	return res, err
+}
+
+// RateScriptLoad implements ratelimiter.RedisClient, it loads the FixedWindow, peek and refund
+// scripts of a Limiter, with or without Options.ServerTime, matched by their SHA1 digests.
+func (c *RedisClient) RateScriptLoad(ctx context.Context, script string) (string, error) {
+	sum := sha1.Sum([]byte(script))
+	digest := hex.EncodeToString(sum[:])
+	emulated, ok := emulatedScripts()[digest]
+	if !ok {
+		return "", errors.New("ERR ratelimitertest: unsupported script")
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.scripts[digest] = emulated
+	return digest, nil
+}
+
+// emulatedScripts returns the scripts emulated in Go by their SHA1 digests.
+func emulatedScripts() map[string]redisScript {
+	emulated := make(map[string]redisScript)
+	for name, run := range map[string]func(c *RedisClient, now int64, keys, argv []string) (interface{}, error){
+		scripts.FixedWindow: (*RedisClient).limit,
+		scripts.Peek:        (*RedisClient).peek,
+		scripts.Refund:      (*RedisClient).refund,
+	} {
+		digests := scripts.Lookup(name)
+		emulated[digests.Sha1] = redisScript{run: run}
+		emulated[digests.ServerTimeSha1] = redisScript{run: run, serverTime: true}
+	}
+	return emulated
+}
+
+// FlushScripts removes the loaded scripts like SCRIPT FLUSH, e.g. to test the NOSCRIPT retry
+// after a redis restart.
+func (c *RedisClient) FlushScripts() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.scripts = make(map[string]redisScript)
+}
+
+// limit runs ratelimiter.lua.
+func (c *RedisClient) limit(now int64, keys, argv []string) (interface{}, error) {
+	res := make([]int64, 6)
+	cost := atoi(argv[1])
+	policyCount := int64(len(argv)-2) / 2
+	limit := c.hmget(keys[0], "ct", "lt", "dn", "rt", "ix")
+
+	if limit[0] != nil {
+		count := atoi(*limit[0])
+		res[1] = atoi(*limit[1])
+		res[2] = atoi(*limit[2])
+		res[3] = atoi(*limit[3])
+		res[5] = 1
+		if limit[4] != nil {
+			res[5] = atoi(*limit[4])
+		}
+
+		if count >= cost {
+			res[0] = count - cost
+			c.hincrby(keys[0], "ct", -cost)
+		} else {
+			res[0] = -1
+			if count == 0 {
+				if policyCount > 1 {
+					c.incr(keys[1])
+					c.pexpire(keys[1], res[2]*2)
+					if index := c.get(keys[1]); index != nil && atoi(*index) == 1 {
+						c.incr(keys[1])
+					}
+				}
+				c.hincrby(keys[0], "ct", -1)
+			}
+		}
+	} else {
+		index := int64(1)
+		if policyCount > 1 {
+			if value := c.get(keys[1]); value != nil {
+				index = atoi(*value)
+			}
+			if index > policyCount {
+				index = policyCount
+			}
+		}
+
+		total := atoi(argv[index*2])
+		count := total
+		if total >= cost {
+			count = total - cost
+			res[0] = count
+		} else {
+			res[0] = -1
+		}
+		res[1] = total
+		res[2] = atoi(argv[index*2+1])
+		res[3] = now + res[2]
+		res[5] = index
+
+		c.hmset(keys[0], "ct", count, "lt", res[1], "dn", res[2], "rt", res[3], "ix", index)
+		c.pexpire(keys[0], res[2])
+	}
+
+	return reply(res), nil
+}
+
+// peek runs the FixedWindow branch of peek.lua.
+func (c *RedisClient) peek(now int64, keys, argv []string) (interface{}, error) {
+	if argv[1] != ratelimiter.FixedWindow.String() {
+		return nil, errors.New("ERR ratelimitertest: unsupported algorithm " + argv[1])
+	}
+	res := make([]int64, 6)
+	limit := c.hmget(keys[0], "ct", "lt", "dn", "rt", "ix")
+	if limit[0] != nil {
+		res[0] = atoi(*limit[0])
+		if res[0] < 0 {
+			res[0] = 0
+		}
+		res[1] = atoi(*limit[1])
+		res[2] = atoi(*limit[2])
+		res[3] = atoi(*limit[3])
+		res[5] = 1
+		if limit[4] != nil {
+			res[5] = atoi(*limit[4])
+		}
+	} else {
+		policyCount := int64(len(argv)-2) / 2
+		index := int64(1)
+		if policyCount > 1 {
+			if value := c.get(keys[1]); value != nil {
+				index = atoi(*value)
+			}
+			if index > policyCount {
+				index = policyCount
+			}
+		}
+		res[0] = atoi(argv[index*2])
+		res[1] = res[0]
+		res[2] = atoi(argv[index*2+1])
+		res[3] = now
+		res[5] = index
+	}
+	return reply(res), nil
+}
+
+// refund runs the FixedWindow branch of refund.lua.
+func (c *RedisClient) refund(now int64, keys, argv []string) (interface{}, error) {
+	if argv[1] != ratelimiter.FixedWindow.String() {
+		return nil, errors.New("ERR ratelimitertest: unsupported algorithm " + argv[1])
+	}
+	cost := atoi(argv[2])
+	reset := atoi(argv[4])
+	limit := c.hmget(keys[0], "ct", "lt", "rt")
+	if limit[2] == nil || atoi(*limit[2]) != reset {
+		return int64(0), nil
+	}
+	count := atoi(*limit[0])
+	if count < 0 {
+		count = 0
+	}
+	count += cost
+	if total := atoi(*limit[1]); count > total {
+		count = total
+	}
+	c.hset(keys[0], "ct", count)
+	return int64(1), nil
+}
+
+func (c *RedisClient) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock.Now()
+}
+
+// expire deletes key if it's expired, the commands call it before reading key.
+func (c *RedisClient) expire(key string) {
+	// a key expires after its deadline, like redis
+	if deadline, ok := c.expires[key]; ok && c.now().After(deadline) {
+		c.del(key)
+	}
+}
+
+func (c *RedisClient) del(key string) {
+	delete(c.hashes, key)
+	delete(c.strings, key)
+	delete(c.expires, key)
+}
+
+func (c *RedisClient) hmget(key string, fields ...string) []*string {
+	c.expire(key)
+	values := make([]*string, len(fields))
+	if hash, ok := c.hashes[key]; ok {
+		for i, field := range fields {
+			if value, ok := hash[field]; ok {
+				values[i] = &value
+			}
+		}
+	}
+	return values
+}
+
+// hmset sets paired fields and values of key, it's also hset.
+func (c *RedisClient) hmset(key string, pairs ...interface{}) {
+	c.expire(key)
+	hash, ok := c.hashes[key]
+	if !ok {
+		hash = make(map[string]string)
+		c.hashes[key] = hash
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		hash[pairs[i].(string)] = strconv.FormatInt(pairs[i+1].(int64), 10)
+	}
+}
+
+func (c *RedisClient) hset(key, field string, value int64) {
+	c.hmset(key, field, value)
+}
+
+func (c *RedisClient) hincrby(key, field string, n int64) {
+	value := int64(0)
+	if values := c.hmget(key, field); values[0] != nil {
+		value = atoi(*values[0])
+	}
+	c.hset(key, field, value+n)
+}
+
+func (c *RedisClient) get(key string) *string {
+	c.expire(key)
+	if value, ok := c.strings[key]; ok {
+		return &value
+	}
+	return nil
+}
+
+func (c *RedisClient) incr(key string) {
+	value := int64(0)
+	if s := c.get(key); s != nil {
+		value = atoi(*s)
+	}
+	c.strings[key] = strconv.FormatInt(value+1, 10)
+}
+
+func (c *RedisClient) pexpire(key string, ms int64) {
+	c.expire(key)
+	if _, ok := c.hashes[key]; !ok {
+		if _, ok := c.strings[key]; !ok {
+			return
+		}
+	}
+	c.expires[key] = c.now().Add(time.Duration(ms) * time.Millisecond)
+}
+
+// reply returns res as a redis array reply.
+func reply(res []int64) []interface{} {
+	arr := make([]interface{}, len(res))
+	for i, v := range res {
+		arr[i] = v
+	}
+	return arr
+}
+
+// atoi parses an integer like lua tonumber, it's 0 if s is invalid.
+func atoi(s string) int64 {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		f, _ := strconv.ParseFloat(s, 64)
+		return int64(f)
+	}
+	return n
+}
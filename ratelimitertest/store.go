@@ -0,0 +1,169 @@
+package ratelimitertest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"testing"
+	"time"
+
+	ratelimiter "github.com/ilam01/limits-go"
+)
+
+// TestStore runs the conformance tests of a ratelimiter.Store, every test uses a Store made by
+// newStore and closes it. The Store may implement any algorithm, the tests only check the
+// behaviors shared by all of them, with a policy of 10 per minute.
+/*
+TestStore checks a custom Store:
+
+    func TestMyStore(t *testing.T) {
+        ratelimitertest.TestStore(t, func() ratelimiter.Store {
+            return NewMyStore(client)
+        })
+    }
+*/
+func TestStore(t *testing.T, newStore func() ratelimiter.Store) {
+	ctx := context.Background()
+	policy := ratelimiter.Policy{{Max: 10, Duration: time.Minute}}
+
+	run := func(name string, test func(t *testing.T, store ratelimiter.Store)) {
+		t.Run(name, func(t *testing.T) {
+			store := newStore()
+			defer store.Close()
+			test(t, store)
+		})
+	}
+
+	run("Take should consume units", func(t *testing.T, store ratelimiter.Store) {
+		key := genKey()
+		start := time.Now().Truncate(time.Millisecond)
+		res := take(t, store, key, 1, policy)
+		end := time.Now()
+		checkResult(t, res, 9)
+		// a sliding window resets up to the end of the next window
+		if res.Reset.Before(start) || res.Reset.After(end.Add(2*time.Minute)) {
+			t.Errorf("Take Reset = %v, want in [%v, %v]", res.Reset, start, end.Add(2*time.Minute))
+		}
+		checkResult(t, take(t, store, key, 9, policy), 0)
+		checkResult(t, take(t, store, key, 1, policy), -1)
+	})
+
+	run("Take should not consume refused units", func(t *testing.T, store ratelimiter.Store) {
+		key := genKey()
+		checkResult(t, take(t, store, key, 8, policy), 2)
+		checkResult(t, take(t, store, key, 5, policy), -1)
+		checkResult(t, take(t, store, key, 2, policy), 0)
+	})
+
+	run("Take should isolate keys", func(t *testing.T, store ratelimiter.Store) {
+		key, other := genKey(), genKey()
+		checkResult(t, take(t, store, key, 10, policy), 0)
+		checkResult(t, take(t, store, other, 1, policy), 9)
+	})
+
+	run("Take should be atomic", func(t *testing.T, store ratelimiter.Store) {
+		key := genKey()
+		var wg sync.WaitGroup
+		var lock sync.Mutex
+		allowed := 0
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res, err := store.Take(ctx, key, 1, policy)
+				if err != nil {
+					t.Errorf("Take error: %v", err)
+					return
+				}
+				if res.Remaining >= 0 {
+					lock.Lock()
+					allowed++
+					lock.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if allowed != 10 {
+			t.Errorf("concurrent Take allowed %d requests, want 10", allowed)
+		}
+	})
+
+	run("Peek should not consume units", func(t *testing.T, store ratelimiter.Store) {
+		key := genKey()
+		checkResult(t, peek(t, store, key, policy), 10)
+		checkResult(t, take(t, store, key, 3, policy), 7)
+		checkResult(t, peek(t, store, key, policy), 7)
+		checkResult(t, peek(t, store, key, policy), 7)
+		checkResult(t, take(t, store, key, 7, policy), 0)
+		checkResult(t, peek(t, store, key, policy), 0)
+	})
+
+	run("Remove should reset the key", func(t *testing.T, store ratelimiter.Store) {
+		key := genKey()
+		checkResult(t, take(t, store, key, 10, policy), 0)
+		if err := store.Remove(ctx, key); err != nil {
+			t.Fatalf("Remove error: %v", err)
+		}
+		if err := store.Remove(ctx, key); err != nil {
+			t.Fatalf("Remove of a removed key error: %v", err)
+		}
+		checkResult(t, peek(t, store, key, policy), 10)
+		checkResult(t, take(t, store, key, 1, policy), 9)
+	})
+
+	run("Refund should give back units", func(t *testing.T, store ratelimiter.Store) {
+		key := genKey()
+		at := time.Now()
+		res := take(t, store, key, 4, policy)
+		checkResult(t, res, 6)
+		refunded, err := store.Refund(ctx, key, 4, at, res.Reset, policy)
+		if err != nil {
+			t.Fatalf("Refund error: %v", err)
+		}
+		if !refunded {
+			t.Fatalf("Refund = false, want true")
+		}
+		checkResult(t, peek(t, store, key, policy), 10)
+
+		refunded, err = store.Refund(ctx, genKey(), 1, at, res.Reset, policy)
+		if err != nil {
+			t.Fatalf("Refund of a missing key error: %v", err)
+		}
+		if refunded {
+			t.Errorf("Refund of a missing key = true, want false")
+		}
+	})
+}
+
+func take(t *testing.T, store ratelimiter.Store, key string, cost int, policy ratelimiter.Policy) ratelimiter.Result {
+	t.Helper()
+	res, err := store.Take(context.Background(), key, cost, policy)
+	if err != nil {
+		t.Fatalf("Take(%q, %d) error: %v", key, cost, err)
+	}
+	return res
+}
+
+func peek(t *testing.T, store ratelimiter.Store, key string, policy ratelimiter.Policy) ratelimiter.Result {
+	t.Helper()
+	res, err := store.Peek(context.Background(), key, policy)
+	if err != nil {
+		t.Fatalf("Peek(%q) error: %v", key, err)
+	}
+	return res
+}
+
+// checkResult checks the Remaining of res, and its Total and Duration of 10 per minute.
+func checkResult(t *testing.T, res ratelimiter.Result, remaining int) {
+	t.Helper()
+	if res.Remaining != remaining || res.Total != 10 || res.Duration != time.Minute {
+		t.Errorf("Result = %d/%d in %v, want %d/10 in 1m", res.Remaining, res.Total, res.Duration, remaining)
+	}
+}
+
+func genKey() string {
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	return "test:" + hex.EncodeToString(buf)
+}
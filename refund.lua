@@ -0,0 +1,85 @@
+-- KEYS[1] target key
+-- ARGV[n >= 7] current timestamp, algorithm, cost, reserved timestamp, reserved reset, max count, duration, ...
+-- Refunds cost units of a reservation only if it's still in the same window, returns 1 if refunded.
+
+local now = tonumber(ARGV[1])
+local algorithm = ARGV[2]
+local cost = tonumber(ARGV[3])
+local at = tonumber(ARGV[4])
+local reset = tonumber(ARGV[5])
+local total = tonumber(ARGV[6])
+local duration = tonumber(ARGV[7])
+
+if algorithm == 'TokenBucket' then
+
+  local tokens = tonumber(redis.call('hget', KEYS[1], 'tk'))
+  if not tokens then
+    return 0
+  end
+  redis.call('hset', KEYS[1], 'tk', math.min(total * duration, tokens + cost * duration))
+
+elseif algorithm == 'GCRA' or algorithm == 'LeakyBucket' then
+
+  local micros = now * 1000
+  local tat = tonumber(redis.call('get', KEYS[1]))
+  if not tat or tat <= micros then
+    return 0
+  end
+  -- a queue slot can only be refunded when no request is scheduled after it
+  if algorithm == 'LeakyBucket' and math.ceil(tat / 1000) ~= reset then
+    return 0
+  end
+  local interval = math.max(math.floor(duration * 1000 / total), 1)
+  tat = math.max(tat - cost * interval, micros)
+  if tat > micros then
+    redis.call('set', KEYS[1], tat, 'px', math.ceil((tat - micros) / 1000))
+  else
+    redis.call('del', KEYS[1])
+  end
+
+elseif algorithm == 'SlidingLog' then
+
+  if at <= now - duration then
+    return 0
+  end
+  -- members are timestamp-sum-cost, see ./slidinglog.lua, the newest requests are refunded
+  local refund = cost
+  while refund > 0 do
+    local newest = redis.call('zrevrangebyscore', KEYS[1], '+inf', '(' .. (now - duration), 'withscores', 'limit', 0, 1)
+    if #newest == 0 then
+      break
+    end
+    local _, _, sum, weight = string.find(newest[1], '%-(%d+)%-(%d+)$')
+    sum = tonumber(sum)
+    weight = tonumber(weight)
+    redis.call('zrem', KEYS[1], newest[1])
+    if weight > refund then
+      redis.call('zadd', KEYS[1], newest[2], string.format('%d-%016d-%d', newest[2], sum - refund, weight - refund))
+      refund = 0
+    else
+      refund = refund - weight
+    end
+  end
+  if refund == cost then
+    return 0
+  end
+
+elseif algorithm == 'SlidingWindow' then
+
+  local window = redis.call('hmget', KEYS[1], 'ws', 'cc')
+  if tonumber(window[1]) ~= at - at % duration then
+    return 0
+  end
+  redis.call('hset', KEYS[1], 'cc', math.max(tonumber(window[2]) - cost, 0))
+
+else
+
+  local limit = redis.call('hmget', KEYS[1], 'ct', 'lt', 'rt')
+  if tonumber(limit[3]) ~= reset then
+    return 0
+  end
+  redis.call('hset', KEYS[1], 'ct', math.min(math.max(tonumber(limit[1]), 0) + cost, tonumber(limit[2])))
+
+end
+
+return 1
@@ -0,0 +1,194 @@
+package ratelimiter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Reservation holds a request consumed by Limiter.Reserve, it can be canceled to refund the units.
+type Reservation struct {
+	Result
+	limiter  *Limiter
+	id       string
+	cost     int
+	policy   Policy
+	at       time.Time
+	lock     sync.Mutex
+	canceled bool
+}
+
+// OK reports whether the request is permitted.
+func (r *Reservation) OK() bool {
+	return r.Allowed
+}
+
+// Cancel refunds the consumed units, and reports whether they are refunded. Units are refunded at
+// most once, and only if the limit record is still in the same window as the reservation. A degraded
+// reservation is refunded to the fallback of FailFallback.
+func (r *Reservation) Cancel(ctx context.Context) (bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.OK() || r.canceled {
+		return false, nil
+	}
+	if err := r.limiter.closed(); err != nil {
+		return false, err
+	}
+
+	refunded, err := r.refund(ctx)
+	if err != nil {
+		return false, err
+	}
+	r.canceled = true
+	return refunded, nil
+}
+
+// refund refunds the units to where they were consumed from, the synthetic result of FailOpen or
+// FailClosed consumed nothing.
+func (r *Reservation) refund(ctx context.Context) (bool, error) {
+	l := r.limiter
+	if !r.Degraded {
+		return l.store.Refund(ctx, l.prefix+r.id, r.cost, r.at, r.Reset, l.policy(r.policy))
+	}
+	if l.failureMode != FailFallback {
+		return false, nil
+	}
+	fallback := l.fallback
+	if err := fallback.closed(); err != nil {
+		return false, err
+	}
+	policy := fallback.policy(r.policy.divide(l.instances))
+	return fallback.store.Refund(ctx, fallback.prefix+r.id, r.cost, r.at, r.Reset, policy)
+}
+
+// Reserve get a limiter result for id as a Reservation. support custom limiter policy.
+/*
+Reserve refunds the request if the downstream call is rejected:
+
+    r, err := limiter.Reserve(ctx, userID)
+    if err != nil || !r.OK() {
+        return
+    }
+    if err := callDownstream(); err != nil {
+        r.Cancel(ctx)
+    }
+*/
+func (l *Limiter) Reserve(ctx context.Context, id string, policy ...int) (*Reservation, error) {
+	return l.ReserveN(ctx, id, 1, policy...)
+}
+
+// ReserveN get a limiter result for id as a Reservation, consuming cost units at once.
+func (l *Limiter) ReserveN(ctx context.Context, id string, cost int, policy ...int) (*Reservation, error) {
+	p, err := NewPolicy(policy...)
+	if err != nil {
+		return nil, err
+	}
+	return l.ReserveNPolicy(ctx, id, cost, p)
+}
+
+// ReserveNPolicy get a limiter result for id with a typed Policy as a Reservation, consuming cost
+// units at once.
+func (l *Limiter) ReserveNPolicy(ctx context.Context, id string, cost int, policy Policy) (*Reservation, error) {
+	res, at, err := l.take(ctx, id, cost, policy)
+	if err != nil {
+		return nil, err
+	}
+	return &Reservation{
+		Result:  res,
+		limiter: l,
+		id:      id,
+		cost:    cost,
+		policy:  policy,
+		at:      at,
+	}, nil
+}
+
+// copy from ./refund.lua
+const refundLua string = `
+-- KEYS[1] target key
+-- ARGV[n >= 7] current timestamp, algorithm, cost, reserved timestamp, reserved reset, max count, duration, ...
+-- Refunds cost units of a reservation only if it's still in the same window, returns 1 if refunded.
+
+local now = tonumber(ARGV[1])
+local algorithm = ARGV[2]
+local cost = tonumber(ARGV[3])
+local at = tonumber(ARGV[4])
+local reset = tonumber(ARGV[5])
+local total = tonumber(ARGV[6])
+local duration = tonumber(ARGV[7])
+
+if algorithm == 'TokenBucket' then
+
+  local tokens = tonumber(redis.call('hget', KEYS[1], 'tk'))
+  if not tokens then
+    return 0
+  end
+  redis.call('hset', KEYS[1], 'tk', math.min(total * duration, tokens + cost * duration))
+
+elseif algorithm == 'GCRA' or algorithm == 'LeakyBucket' then
+
+  local micros = now * 1000
+  local tat = tonumber(redis.call('get', KEYS[1]))
+  if not tat or tat <= micros then
+    return 0
+  end
+  -- a queue slot can only be refunded when no request is scheduled after it
+  if algorithm == 'LeakyBucket' and math.ceil(tat / 1000) ~= reset then
+    return 0
+  end
+  local interval = math.max(math.floor(duration * 1000 / total), 1)
+  tat = math.max(tat - cost * interval, micros)
+  if tat > micros then
+    redis.call('set', KEYS[1], tat, 'px', math.ceil((tat - micros) / 1000))
+  else
+    redis.call('del', KEYS[1])
+  end
+
+elseif algorithm == 'SlidingLog' then
+
+  if at <= now - duration then
+    return 0
+  end
+  -- members are timestamp-sum-cost, see ./slidinglog.lua, the newest requests are refunded
+  local refund = cost
+  while refund > 0 do
+    local newest = redis.call('zrevrangebyscore', KEYS[1], '+inf', '(' .. (now - duration), 'withscores', 'limit', 0, 1)
+    if #newest == 0 then
+      break
+    end
+    local _, _, sum, weight = string.find(newest[1], '%-(%d+)%-(%d+)$')
+    sum = tonumber(sum)
+    weight = tonumber(weight)
+    redis.call('zrem', KEYS[1], newest[1])
+    if weight > refund then
+      redis.call('zadd', KEYS[1], newest[2], string.format('%d-%016d-%d', newest[2], sum - refund, weight - refund))
+      refund = 0
+    else
+      refund = refund - weight
+    end
+  end
+  if refund == cost then
+    return 0
+  end
+
+elseif algorithm == 'SlidingWindow' then
+
+  local window = redis.call('hmget', KEYS[1], 'ws', 'cc')
+  if tonumber(window[1]) ~= at - at % duration then
+    return 0
+  end
+  redis.call('hset', KEYS[1], 'cc', math.max(tonumber(window[2]) - cost, 0))
+
+else
+
+  local limit = redis.call('hmget', KEYS[1], 'ct', 'lt', 'rt')
+  if tonumber(limit[3]) ~= reset then
+    return 0
+  end
+  redis.call('hset', KEYS[1], 'ct', math.min(math.max(tonumber(limit[1]), 0) + cost, tonumber(limit[2])))
+
+end
+
+return 1
+`
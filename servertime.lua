@@ -0,0 +1,28 @@
+-- Runs a limiter script with the redis server time as the current timestamp.
+-- The client timestamp ARGV[1] is only used if the script effects can't be replicated.
+-- A table result is padded to 6 items, and the server timestamp is appended as res[7].
+
+local now = tonumber(ARGV[1])
+if redis.replicate_commands and redis.replicate_commands() then
+  local time = redis.call('TIME')
+  now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+end
+
+local argv = {}
+for i = 1, #ARGV do
+  argv[i] = ARGV[i]
+end
+argv[1] = now
+local ARGV = argv
+
+local res = (function()
+-- script
+end)()
+
+if type(res) == 'table' then
+  for i = 1, 6 do
+    res[i] = res[i] or 0
+  end
+  res[7] = now
+end
+return res
@@ -0,0 +1,151 @@
+package ratelimiter
+
+import (
+	"time"
+)
+
+// logEntry is an accepted request of the sliding log, weighted by its cost.
+type logEntry struct {
+	at   int64
+	cost int
+}
+
+// logEvent should be called with s.lock held.
+func (s *memoryShard) logEvent(key string, t time.Time, cost int, args ...int) (remaining int, res *limiterCacheItem) {
+	total := args[0]
+	duration := int64(args[1])
+	now := t.UnixNano() / 1e6
+
+	var ok bool
+	if res, ok = s.store[key]; !ok {
+		res = &limiterCacheItem{}
+		s.put(key, res)
+	}
+	expired := 0
+	for expired < len(res.log) && res.log[expired].at <= now-duration {
+		res.logged -= res.log[expired].cost
+		expired++
+	}
+	res.log = res.log[expired:]
+
+	if res.logged+cost <= total {
+		res.log = append(res.log, logEntry{now, cost})
+		res.logged += cost
+		remaining = total - res.logged
+	} else {
+		remaining = -1
+	}
+	res.total = total
+	res.duration = time.Duration(duration) * time.Millisecond
+	oldest := now
+	if len(res.log) > 0 {
+		oldest = res.log[0].at
+	}
+	res.expire = time.Unix(0, (oldest+duration)*1e6)
+	return
+}
+
+// peekLog should be called with s.lock held.
+func (s *memoryShard) peekLog(key string, t time.Time, args ...int) []interface{} {
+	total := args[0]
+	duration := int64(args[1])
+	now := t.UnixNano() / 1e6
+
+	count := 0
+	oldest := now
+	if res, ok := s.store[key]; ok {
+		count = res.logged
+		for _, entry := range res.log {
+			if entry.at > now-duration {
+				oldest = entry.at
+				break
+			}
+			count -= entry.cost
+		}
+	}
+	remaining := total - count
+	if remaining < 0 {
+		remaining = 0
+	}
+	return []interface{}{remaining, total, time.Duration(duration) * time.Millisecond,
+		time.Unix(0, (oldest+duration)*1e6), time.Duration(0)}
+}
+
+func (item *limiterCacheItem) refundLog(t time.Time, cost int, at time.Time, args ...int) bool {
+	duration := int64(args[1])
+	now := t.UnixNano() / 1e6
+	if at.UnixNano()/1e6 <= now-duration {
+		return false
+	}
+	refunded := false
+	for cost > 0 && len(item.log) > 0 {
+		last := &item.log[len(item.log)-1]
+		if last.at <= now-duration {
+			break
+		}
+		refunded = true
+		if last.cost > cost {
+			last.cost -= cost
+			item.logged -= cost
+			break
+		}
+		cost -= last.cost
+		item.logged -= last.cost
+		item.log = item.log[:len(item.log)-1]
+	}
+	return refunded
+}
+
+// copy from ./slidinglog.lua
+const slidingLogLua string = `
+-- KEYS[1] target sorted set key
+-- ARGV[n >= 4] current timestamp, cost, max count, duration, ...
+-- Only the first max/duration pair is used.
+
+-- ZSET: KEYS[1]
+--   member:timestamp-sum-cost of an accepted request, sum is the running total of the costs logged
+--     up to it, zero padded so that requests of the same timestamp are ordered by it
+--   score:timestamp of an accepted request
+
+local now = tonumber(ARGV[1])
+local cost = tonumber(ARGV[2])
+local total = tonumber(ARGV[3])
+local duration = tonumber(ARGV[4])
+
+local function parse(member)
+  local _, _, sum, weight = string.find(member, '%-(%d+)%-(%d+)$')
+  return tonumber(sum), tonumber(weight)
+end
+
+redis.call('zremrangebyscore', KEYS[1], '-inf', now - duration)
+
+-- the count in the log is the sum of the newest request minus the sum before the oldest one
+local count = 0
+local sum = 0
+local at = now
+local newest = redis.call('zrange', KEYS[1], -1, -1, 'withscores')
+if #newest > 0 then
+  local oldest = redis.call('zrange', KEYS[1], 0, 0)
+  local first, weight = parse(oldest[1])
+  sum = parse(newest[1])
+  count = sum - first + weight
+  -- keep the log ordered by the sum even if the clock goes back
+  at = math.max(at, tonumber(newest[2]))
+end
+
+local res = {}
+if count + cost <= total then
+  redis.call('zadd', KEYS[1], at, string.format('%d-%016d-%d', at, sum + cost, cost))
+  redis.call('pexpire', KEYS[1], at - now + duration)
+  res[1] = total - count - cost
+else
+  res[1] = -1
+end
+
+local oldest = redis.call('zrange', KEYS[1], 0, 0, 'withscores')
+res[2] = total
+res[3] = duration
+res[4] = (tonumber(oldest[2]) or now) + duration
+
+return res
+`
@@ -0,0 +1,50 @@
+-- KEYS[1] target sorted set key
+-- ARGV[n >= 4] current timestamp, cost, max count, duration, ...
+-- Only the first max/duration pair is used.
+
+-- ZSET: KEYS[1]
+--   member:timestamp-sum-cost of an accepted request, sum is the running total of the costs logged
+--     up to it, zero padded so that requests of the same timestamp are ordered by it
+--   score:timestamp of an accepted request
+
+local now = tonumber(ARGV[1])
+local cost = tonumber(ARGV[2])
+local total = tonumber(ARGV[3])
+local duration = tonumber(ARGV[4])
+
+local function parse(member)
+  local _, _, sum, weight = string.find(member, '%-(%d+)%-(%d+)$')
+  return tonumber(sum), tonumber(weight)
+end
+
+redis.call('zremrangebyscore', KEYS[1], '-inf', now - duration)
+
+-- the count in the log is the sum of the newest request minus the sum before the oldest one
+local count = 0
+local sum = 0
+local at = now
+local newest = redis.call('zrange', KEYS[1], -1, -1, 'withscores')
+if #newest > 0 then
+  local oldest = redis.call('zrange', KEYS[1], 0, 0)
+  local first, weight = parse(oldest[1])
+  sum = parse(newest[1])
+  count = sum - first + weight
+  -- keep the log ordered by the sum even if the clock goes back
+  at = math.max(at, tonumber(newest[2]))
+end
+
+local res = {}
+if count + cost <= total then
+  redis.call('zadd', KEYS[1], at, string.format('%d-%016d-%d', at, sum + cost, cost))
+  redis.call('pexpire', KEYS[1], at - now + duration)
+  res[1] = total - count - cost
+else
+  res[1] = -1
+end
+
+local oldest = redis.call('zrange', KEYS[1], 0, 0, 'withscores')
+res[2] = total
+res[3] = duration
+res[4] = (tonumber(oldest[2]) or now) + duration
+
+return res
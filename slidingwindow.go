@@ -0,0 +1,195 @@
+package ratelimiter
+
+import (
+	"time"
+)
+
+// countWindow should be called with s.lock held.
+func (s *memoryShard) countWindow(key string, t time.Time, cost int, args ...int) (remaining int, res *limiterCacheItem) {
+	total := int64(args[0])
+	duration := int64(args[1])
+	now := t.UnixNano() / 1e6
+	start := now - now%duration
+
+	var ok bool
+	if res, ok = s.store[key]; !ok {
+		res = &limiterCacheItem{window: start}
+		s.put(key, res)
+	}
+	if res.window > start {
+		start = res.window
+	} else if res.window < start {
+		if res.window+duration == start {
+			res.previous = res.current
+		} else {
+			res.previous = 0
+		}
+		res.current = 0
+		res.window = start
+	}
+
+	// the weighted count is multiplied by duration to keep integers
+	elapsed := now - start
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	weighted := res.previous*(duration-elapsed) + res.current*duration
+
+	if need := int64(cost) * duration; weighted+need <= total*duration {
+		res.current += int64(cost)
+		weighted += need
+		remaining = int((total*duration - weighted) / duration)
+	} else {
+		remaining = -1
+	}
+	res.total = int(total)
+	res.duration = time.Duration(duration) * time.Millisecond
+
+	// reset is the time the interpolated count frees one more request
+	used := (weighted + duration - 1) / duration
+	if used > total {
+		used = total
+	}
+	if used < 1 {
+		used = 1
+	}
+	target := (used - 1) * duration
+	var reset int64
+	if res.current*duration <= target {
+		if res.previous > 0 {
+			reset = start + duration - (target-res.current*duration)/res.previous
+		} else {
+			reset = now
+		}
+	} else {
+		reset = start + duration*2 - target/res.current
+	}
+	res.expire = time.Unix(0, reset*1e6)
+	return
+}
+
+// peekWindow should be called with s.lock held.
+func (s *memoryShard) peekWindow(key string, t time.Time, args ...int) []interface{} {
+	total := int64(args[0])
+	duration := int64(args[1])
+	now := t.UnixNano() / 1e6
+	start := now - now%duration
+
+	var current, previous int64
+	if res, ok := s.store[key]; ok {
+		if res.window > start {
+			start = res.window
+			current, previous = res.current, res.previous
+		} else if res.window == start {
+			current, previous = res.current, res.previous
+		} else if res.window+duration == start {
+			previous = res.current
+		}
+	}
+
+	elapsed := now - start
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	weighted := previous*(duration-elapsed) + current*duration
+	remaining := (total*duration - weighted) / duration
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	used := (weighted + duration - 1) / duration
+	if used > total {
+		used = total
+	}
+	if used < 1 {
+		used = 1
+	}
+	target := (used - 1) * duration
+	reset := now
+	if current*duration > target {
+		reset = start + duration*2 - target/current
+	} else if previous > 0 {
+		reset = start + duration - (target-current*duration)/previous
+	}
+	return []interface{}{int(remaining), int(total), time.Duration(duration) * time.Millisecond,
+		time.Unix(0, reset*1e6), time.Duration(0)}
+}
+
+func (item *limiterCacheItem) refundWindow(cost int, at time.Time, args ...int) bool {
+	duration := int64(args[1])
+	reserved := at.UnixNano() / 1e6
+	if item.window != reserved-reserved%duration {
+		return false
+	}
+	item.current -= int64(cost)
+	if item.current < 0 {
+		item.current = 0
+	}
+	return true
+}
+
+// copy from ./slidingwindow.lua
+const slidingWindowLua string = `
+-- KEYS[1] target hash key
+-- ARGV[n >= 4] current timestamp, cost, max count, duration, ...
+-- Only the first max/duration pair is used.
+
+-- HASH: KEYS[1]
+--   field:ws(current window start timestamp)
+--   field:cc(current window count)
+--   field:pc(previous window count)
+
+local now = tonumber(ARGV[1])
+local cost = tonumber(ARGV[2])
+local total = tonumber(ARGV[3])
+local duration = tonumber(ARGV[4])
+local start = now - now % duration
+
+local window = redis.call('hmget', KEYS[1], 'ws', 'cc', 'pc')
+local last = tonumber(window[1]) or start
+local current = tonumber(window[2]) or 0
+local previous = tonumber(window[3]) or 0
+
+if last > start then
+  start = last
+elseif last < start then
+  if last + duration == start then
+    previous = current
+  else
+    previous = 0
+  end
+  current = 0
+end
+
+-- the weighted count is multiplied by duration to keep integers
+local elapsed = math.max(now - start, 0)
+local weighted = previous * (duration - elapsed) + current * duration
+
+local res = {}
+if weighted + cost * duration <= total * duration then
+  current = current + cost
+  weighted = weighted + cost * duration
+  res[1] = math.floor((total * duration - weighted) / duration)
+else
+  res[1] = -1
+end
+res[2] = total
+res[3] = duration
+
+-- reset is the time the interpolated count frees one more request
+local target = (math.max(math.min(math.ceil(weighted / duration), total), 1) - 1) * duration
+if current * duration <= target then
+  if previous > 0 then
+    res[4] = start + duration - math.floor((target - current * duration) / previous)
+  else
+    res[4] = now
+  end
+else
+  res[4] = start + duration * 2 - math.floor(target / current)
+end
+
+redis.call('hmset', KEYS[1], 'ws', start, 'cc', current, 'pc', previous)
+redis.call('pexpire', KEYS[1], start + duration * 2 - now)
+
+return res
+`
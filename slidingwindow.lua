@@ -0,0 +1,62 @@
+-- KEYS[1] target hash key
+-- ARGV[n >= 4] current timestamp, cost, max count, duration, ...
+-- Only the first max/duration pair is used.
+
+-- HASH: KEYS[1]
+--   field:ws(current window start timestamp)
+--   field:cc(current window count)
+--   field:pc(previous window count)
+
+local now = tonumber(ARGV[1])
+local cost = tonumber(ARGV[2])
+local total = tonumber(ARGV[3])
+local duration = tonumber(ARGV[4])
+local start = now - now % duration
+
+local window = redis.call('hmget', KEYS[1], 'ws', 'cc', 'pc')
+local last = tonumber(window[1]) or start
+local current = tonumber(window[2]) or 0
+local previous = tonumber(window[3]) or 0
+
+if last > start then
+  start = last
+elseif last < start then
+  if last + duration == start then
+    previous = current
+  else
+    previous = 0
+  end
+  current = 0
+end
+
+-- the weighted count is multiplied by duration to keep integers
+local elapsed = math.max(now - start, 0)
+local weighted = previous * (duration - elapsed) + current * duration
+
+local res = {}
+if weighted + cost * duration <= total * duration then
+  current = current + cost
+  weighted = weighted + cost * duration
+  res[1] = math.floor((total * duration - weighted) / duration)
+else
+  res[1] = -1
+end
+res[2] = total
+res[3] = duration
+
+-- reset is the time the interpolated count frees one more request
+local target = (math.max(math.min(math.ceil(weighted / duration), total), 1) - 1) * duration
+if current * duration <= target then
+  if previous > 0 then
+    res[4] = start + duration - math.floor((target - current * duration) / previous)
+  else
+    res[4] = now
+  end
+else
+  res[4] = start + duration * 2 - math.floor(target / current)
+end
+
+redis.call('hmset', KEYS[1], 'ws', start, 'cc', current, 'pc', previous)
+redis.call('pexpire', KEYS[1], start + duration * 2 - now)
+
+return res
@@ -0,0 +1,45 @@
+package ratelimiter
+
+import (
+	"context"
+	"time"
+)
+
+// Store is the backend of a Limiter, it keeps the limit records of keys. The memory and redis
+// limiters are Stores, and Options.Store plugs in a custom one.
+//
+// A Store implements the Options.Algorithm of its Limiter. The keys have Options.Prefix, and a
+// policy is never empty, a Limiter passes the tier of Options.Max and Options.Duration for no
+// policy. The methods must be safe for concurrent use.
+/*
+Store wraps the memory limiter to count the evaluated keys:
+
+    type countingStore struct {
+        ratelimiter.Store
+        count int64
+    }
+
+    func (s *countingStore) Take(ctx context.Context, key string, cost int, policy ratelimiter.Policy) (ratelimiter.Result, error) {
+        atomic.AddInt64(&s.count, 1)
+        return s.Store.Take(ctx, key, cost, policy)
+    }
+
+    store, _ := ratelimiter.NewMemoryStore(ratelimiter.Options{})
+    limiter := ratelimiter.New(ratelimiter.Options{Store: &countingStore{Store: store}})
+*/
+type Store interface {
+	// Take evaluates policy on key atomically, consuming cost units if they are available. The
+	// Remaining of the Result is -1 if nothing is consumed, and only its Total, Remaining,
+	// Duration, Reset, Delay and Tier are used.
+	Take(ctx context.Context, key string, cost int, policy Policy) (Result, error)
+	// Peek returns the current Result of key without consuming or changing anything. Remaining
+	// is the count still allowed, and it's Total with Reset now if no record exists.
+	Peek(ctx context.Context, key string, policy Policy) (Result, error)
+	// Refund gives back cost units taken at at with a Result reset at reset, only if the record is
+	// still in the same window, and reports whether they are refunded.
+	Refund(ctx context.Context, key string, cost int, at, reset time.Time, policy Policy) (bool, error)
+	// Remove deletes the record of key.
+	Remove(ctx context.Context, key string) error
+	// Close releases the resources of the Store, it's called once by Limiter.Close.
+	Close() error
+}
@@ -0,0 +1,114 @@
+package ratelimiter
+
+import (
+	"time"
+)
+
+// takeToken should be called with s.lock held.
+func (s *memoryShard) takeToken(key string, t time.Time, cost int, args ...int) (remaining int, res *limiterCacheItem) {
+	capacity := int64(args[0])
+	duration := int64(args[1])
+	full := capacity * duration
+	now := t.UnixNano() / 1e6
+
+	var ok bool
+	if res, ok = s.store[key]; !ok {
+		res = &limiterCacheItem{tokens: full, last: now}
+		s.put(key, res)
+	}
+	if now > res.last {
+		res.tokens += (now - res.last) * capacity
+		if res.tokens > full {
+			res.tokens = full
+		}
+		res.last = now
+	}
+
+	if need := int64(cost) * duration; res.tokens >= need {
+		res.tokens -= need
+		remaining = int(res.tokens / duration)
+	} else {
+		remaining = -1
+	}
+	res.total = int(capacity)
+	res.duration = time.Duration(duration) * time.Millisecond
+	reset := res.last + (full-res.tokens+capacity-1)/capacity
+	res.expire = time.Unix(0, reset*1e6)
+	return
+}
+
+// peekToken should be called with s.lock held.
+func (s *memoryShard) peekToken(key string, t time.Time, args ...int) []interface{} {
+	capacity := int64(args[0])
+	duration := int64(args[1])
+	full := capacity * duration
+	now := t.UnixNano() / 1e6
+
+	tokens, last := full, now
+	if res, ok := s.store[key]; ok {
+		tokens, last = res.tokens, res.last
+	}
+	if now > last {
+		tokens += (now - last) * capacity
+		if tokens > full {
+			tokens = full
+		}
+		last = now
+	}
+	reset := last + (full-tokens+capacity-1)/capacity
+	return []interface{}{int(tokens / duration), int(capacity), time.Duration(duration) * time.Millisecond,
+		time.Unix(0, reset*1e6), time.Duration(0)}
+}
+
+func (item *limiterCacheItem) refundToken(cost int, args ...int) bool {
+	full := int64(args[0]) * int64(args[1])
+	item.tokens += int64(cost) * int64(args[1])
+	if item.tokens > full {
+		item.tokens = full
+	}
+	return true
+}
+
+// copy from ./tokenbucket.lua
+const tokenBucketLua string = `
+-- KEYS[1] target hash key
+-- ARGV[n >= 4] current timestamp, cost, capacity, duration to refill a whole bucket, ...
+-- Only the first capacity/duration pair is used.
+
+-- HASH: KEYS[1]
+--   field:tk(tokens, in token-milliseconds: one token is duration units)
+--   field:ts(last refill timestamp)
+
+local now = tonumber(ARGV[1])
+local cost = tonumber(ARGV[2])
+local capacity = tonumber(ARGV[3])
+local duration = tonumber(ARGV[4])
+local full = capacity * duration
+
+local bucket = redis.call('hmget', KEYS[1], 'tk', 'ts')
+local tokens = tonumber(bucket[1]) or full
+local last = tonumber(bucket[2]) or now
+
+if now > last then
+  tokens = math.min(full, tokens + (now - last) * capacity)
+  last = now
+end
+
+local res = {}
+if tokens >= cost * duration then
+  tokens = tokens - cost * duration
+  res[1] = math.floor(tokens / duration)
+else
+  res[1] = -1
+end
+res[2] = capacity
+res[3] = duration
+res[4] = last + math.ceil((full - tokens) / capacity)
+
+if tokens < full then
+  redis.call('hmset', KEYS[1], 'tk', tokens, 'ts', last)
+  redis.call('pexpire', KEYS[1], res[4] - now)
+end
+
+return res
+`
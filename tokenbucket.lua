@@ -0,0 +1,40 @@
+-- KEYS[1] target hash key
+-- ARGV[n >= 4] current timestamp, cost, capacity, duration to refill a whole bucket, ...
+-- Only the first capacity/duration pair is used.
+
+-- HASH: KEYS[1]
+--   field:tk(tokens, in token-milliseconds: one token is duration units)
+--   field:ts(last refill timestamp)
+
+local now = tonumber(ARGV[1])
+local cost = tonumber(ARGV[2])
+local capacity = tonumber(ARGV[3])
+local duration = tonumber(ARGV[4])
+local full = capacity * duration
+
+local bucket = redis.call('hmget', KEYS[1], 'tk', 'ts')
+local tokens = tonumber(bucket[1]) or full
+local last = tonumber(bucket[2]) or now
+
+if now > last then
+  tokens = math.min(full, tokens + (now - last) * capacity)
+  last = now
+end
+
+local res = {}
+if tokens >= cost * duration then
+  tokens = tokens - cost * duration
+  res[1] = math.floor(tokens / duration)
+else
+  res[1] = -1
+end
+res[2] = capacity
+res[3] = duration
+res[4] = last + math.ceil((full - tokens) / capacity)
+
+if tokens < full then
+  redis.call('hmset', KEYS[1], 'tk', tokens, 'ts', last)
+  redis.call('pexpire', KEYS[1], res[4] - now)
+end
+
+return res